@@ -0,0 +1,343 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    blackoutsPath = roomControllerBasePath + "blackouts.json"
+
+    // Prefix of schedules created by a calendar import
+    icalSchedulePrefix = "ical-"
+)
+
+// Blackout is a busy or "away" calendar event. No cleaning starts while one
+// of its occurrences is running.
+type Blackout struct {
+    UID     string      `json:"uid"`
+    Summary string      `json:"summary"`
+    Start   time.Time   `json:"start"`
+    End     time.Time   `json:"end"`
+    Rule    *RRule      `json:"rule,omitempty"`
+}
+
+type CalendarImportEvent struct {
+    UID         string  `json:"uid"`
+    Summary     string  `json:"summary"`
+    Schedule    string  `json:"schedule,omitempty"`
+}
+
+type CalendarImportResult struct {
+    Schedules   []CalendarImportEvent   `json:"schedules"`
+    Blackouts   []CalendarImportEvent   `json:"blackouts"`
+    Failed      []icalParseError        `json:"failed"`
+}
+
+var blackoutsMutex sync.Mutex
+var blackouts []Blackout
+
+func loadBlackouts() error {
+    var stored []Blackout
+
+    if err := ReadJSONFile(blackoutsPath, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    blackoutsMutex.Lock()
+    blackouts = stored
+    blackoutsMutex.Unlock()
+
+    return nil
+}
+
+func listBlackouts() []Blackout {
+    blackoutsMutex.Lock()
+    defer blackoutsMutex.Unlock()
+
+    return append([]Blackout{}, blackouts...)
+}
+
+// Occurrence returns the end of the occurrence running at t.
+func (blackout Blackout) Occurrence(t time.Time) (time.Time, bool) {
+    var end time.Time
+    duration := blackout.End.Sub(blackout.Start)
+
+    if blackout.Rule == nil {
+        return blackout.End, !t.Before(blackout.Start) && t.Before(blackout.End)
+    }
+
+    blackout.Rule.Occurrences(blackout.Start, func(start time.Time) bool {
+        if start.After(t) {
+            return false
+        }
+
+        if t.Before(start.Add(duration)) {
+            end = start.Add(duration)
+            return false
+        }
+
+        return true
+    })
+
+    return end, !end.IsZero()
+}
+
+// checkBlackout fails while a blackout window is active.
+func checkBlackout() error {
+    now := time.Now()
+
+    for _, blackout := range listBlackouts() {
+        if end, active := blackout.Occurrence(now); active {
+            return fmt.Errorf("Cleaning blocked by %q until %s!", blackout.Summary, end.Format(time.RFC3339))
+        }
+    }
+
+    return nil
+}
+
+// Matches the longest stored room name contained in the summary.
+func matchRoom(summary string) string {
+    var match string
+
+    summary = strings.ToLower(summary)
+    for _, room := range listRooms() {
+        if strings.Contains(summary, strings.ToLower(room.Name)) && len(room.Name) > len(match) {
+            match = room.Name
+        }
+    }
+
+    return match
+}
+
+// icalCron turns the recurrence of an event into a cron expression.
+func icalCron(event *icalEvent) (string, error) {
+    rule := event.Rule
+
+    if rule == nil {
+        return "", errors.New("event does not recur")
+    }
+
+    if event.AllDay {
+        return "", errors.New("all-day events have no start time")
+    }
+
+    if rule.Interval != 1 {
+        return "", fmt.Errorf("interval %d is not supported", rule.Interval)
+    }
+
+    if rule.Count > 0 {
+        return "", errors.New("COUNT is not supported")
+    }
+
+    if err := checkICalTimeZone(event); err != nil {
+        return "", err
+    }
+
+    minute, hour := event.Start.Minute(), event.Start.Hour()
+
+    switch rule.Freq {
+    case "DAILY":
+        return fmt.Sprintf("%d %d * * *", minute, hour), nil
+    case "WEEKLY":
+        days := []string{}
+        for _, day := range rule.ByDay {
+            days = append(days, strconv.Itoa(int(day)))
+        }
+
+        if len(days) == 0 {
+            days = append(days, strconv.Itoa(int(event.Start.Weekday())))
+        }
+
+        return fmt.Sprintf("%d %d * * %s", minute, hour, strings.Join(days, ",")), nil
+    case "MONTHLY":
+        days := []string{}
+        for _, day := range rule.ByMonthDay {
+            days = append(days, strconv.Itoa(day))
+        }
+
+        if len(days) == 0 {
+            days = append(days, strconv.Itoa(event.Start.Day()))
+        }
+
+        return fmt.Sprintf("%d %d %s * *", minute, hour, strings.Join(days, ",")), nil
+    case "YEARLY":
+        return fmt.Sprintf("%d %d %d %d *", minute, hour, event.Start.Day(), event.Start.Month()), nil
+    }
+
+    return "", errors.New("unsupported frequency " + rule.Freq)
+}
+
+// Cron expressions run in local time. An event in another time zone only keeps
+// its start time if that zone changes its offset at the same time as local
+// time does.
+func checkICalTimeZone(event *icalEvent) error {
+    if event.Location == nil || event.Location == time.Local {
+        return nil
+    }
+
+    offsetAt := func(t time.Time) int {
+        _, offset := t.In(event.Location).Zone()
+        _, local := t.Zone()
+
+        return offset - local
+    }
+
+    start := event.Start
+    difference := offsetAt(start)
+
+    for day := 1; day <= 366; day++ {
+        if offsetAt(start.AddDate(0, 0, day)) != difference {
+            return fmt.Errorf("time zone %s does not switch daylight saving time with local time", event.Location)
+        }
+    }
+
+    return nil
+}
+
+func icalScheduleID(event *icalEvent) string {
+    id := event.UID
+    if id == "" {
+        id = event.Summary + "-" + event.Start.Format("20060102T1504")
+    }
+
+    return icalSchedulePrefix + id
+}
+
+// importCalendar replaces all previously imported schedules and blackouts.
+func importCalendar(data string) (*CalendarImportResult, error) {
+    events, failed, err := ParseICal(data)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &CalendarImportResult{
+        Schedules: []CalendarImportEvent{},
+        Blackouts: []CalendarImportEvent{},
+        Failed: failed,
+    }
+    if result.Failed == nil {
+        result.Failed = []icalParseError{}
+    }
+
+    var newSchedules []*Schedule
+    var newBlackouts []Blackout
+
+    fail := func(event *icalEvent, reason string) {
+        result.Failed = append(result.Failed, icalParseError{
+            UID: event.UID,
+            Summary: event.Summary,
+            Error: reason,
+        })
+    }
+
+    for _, event := range events {
+        imported := CalendarImportEvent{
+            UID: event.UID,
+            Summary: event.Summary,
+        }
+
+        if room := matchRoom(event.Summary); room != "" {
+            expression, err := icalCron(event)
+            if err != nil {
+                fail(event, err.Error())
+                continue
+            }
+
+            schedule := &Schedule{
+                ID: icalScheduleID(event),
+                Cron: expression,
+                Job: CleanRoomRequest{RoomName: room},
+            }
+
+            start := event.Start
+            schedule.Start = &start
+            if !event.Rule.Until.IsZero() {
+                until := event.Rule.Until
+                schedule.Until = &until
+            }
+
+            if err := schedule.parse(); err != nil {
+                fail(event, err.Error())
+                continue
+            }
+
+            imported.Schedule = schedule.ID
+            newSchedules = append(newSchedules, schedule)
+            result.Schedules = append(result.Schedules, imported)
+        } else if event.Busy || strings.Contains(strings.ToLower(event.Summary), "away") {
+            if event.Transparent {
+                fail(event, "transparent events cannot block cleaning")
+                continue
+            }
+
+            newBlackouts = append(newBlackouts, Blackout{
+                UID: event.UID,
+                Summary: event.Summary,
+                Start: event.Start,
+                End: event.End,
+                Rule: event.Rule,
+            })
+            result.Blackouts = append(result.Blackouts, imported)
+        } else {
+            fail(event, "summary names no room and event is neither busy nor away")
+        }
+    }
+
+    schedulesMutex.Lock()
+    previous := schedules
+    updated := map[string]*Schedule{}
+    for id, schedule := range schedules {
+        if !strings.HasPrefix(id, icalSchedulePrefix) {
+            updated[id] = schedule
+        }
+    }
+    for _, schedule := range newSchedules {
+        updated[schedule.ID] = schedule
+    }
+
+    schedules = updated
+    if err := saveSchedules(); err != nil {
+        schedules = previous
+        schedulesMutex.Unlock()
+        return nil, err
+    }
+    schedulesMutex.Unlock()
+
+    blackoutsMutex.Lock()
+    defer blackoutsMutex.Unlock()
+
+    if err := WriteJSONFile(blackoutsPath, newBlackouts); err != nil {
+        return nil, err
+    }
+    blackouts = newBlackouts
+
+    return result, nil
+}
+
+// importCalendarPayload accepts the calendar itself or a path to read it from.
+func importCalendarPayload(payload string) (*CalendarImportResult, error) {
+    if !strings.HasPrefix(strings.TrimSpace(payload), "BEGIN:") {
+        data, err := ioutil.ReadFile(strings.TrimSpace(payload))
+        if err != nil {
+            return nil, err
+        }
+
+        payload = string(data)
+    }
+
+    result, err := importCalendar(payload)
+    if err != nil {
+        return nil, err
+    }
+
+    publishNextScheduledRuns()
+
+    return result, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+
+    "github.com/novag/gen1_room_controller/coords"
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+// Payload fields holding positions
+var coordinateFields = []string{"idle_point", "target", "point"}
+
+// Payload fields holding arrays of objects with positions
+var nestedCoordinateFields = []string{"waypoints", "steps"}
+
+// coordinateFrame returns the frame of the live map as rendered by
+// mapRenderer, pixel coordinates refer to that image.
+func coordinateFrame() (coords.Frame, error) {
+    m, err := rrmap.ReadFile(rockroboBasePath + "last_map")
+    if err != nil {
+        return coords.Frame{}, err
+    }
+
+    dock, _ := rrmap.ReadPose(rockroboBasePath + "ChargerPos.data")
+
+    return coords.NewFrame(m, dock, mapRenderScale), nil
+}
+
+// decodeWithCoordinates unmarshals a payload after converting its positions
+// from the system named in its coordinates field to robot coordinates.
+// Arrays of such payloads are converted element by element.
+func decodeWithCoordinates(data []byte, v interface{}) error {
+    var frame *coords.Frame
+
+    converted, err := convertCoordinates(data, &frame)
+    if err != nil {
+        return err
+    }
+
+    return json.Unmarshal(converted, v)
+}
+
+func convertCoordinates(data []byte, frame **coords.Frame) ([]byte, error) {
+    data = bytes.TrimSpace(data)
+
+    if len(data) > 0 && data[0] == '[' {
+        var elements []json.RawMessage
+        if err := json.Unmarshal(data, &elements); err != nil {
+            return data, nil
+        }
+
+        for index, element := range elements {
+            converted, err := convertCoordinates(element, frame)
+            if err != nil {
+                return nil, err
+            }
+
+            elements[index] = converted
+        }
+
+        return json.Marshal(elements)
+    }
+
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        // Not an object, leave the errors to the caller
+        return data, nil
+    }
+
+    var name string
+    if raw, ok := fields["coordinates"]; ok {
+        if err := json.Unmarshal(raw, &name); err != nil {
+            return nil, err
+        }
+    }
+
+    system, err := coords.ParseSystem(name)
+    if err != nil {
+        return nil, err
+    }
+
+    delete(fields, "coordinates")
+
+    if system == coords.Robot {
+        return data, nil
+    }
+
+    if *frame == nil {
+        f, err := coordinateFrame()
+        if err != nil {
+            return nil, err
+        }
+
+        *frame = &f
+    }
+
+    if err := convertFields(fields, system, *frame); err != nil {
+        return nil, err
+    }
+
+    return json.Marshal(fields)
+}
+
+// convertFields converts the positions of a payload object in place. Objects
+// nested in nestedCoordinateFields use the system of the payload.
+func convertFields(fields map[string]json.RawMessage, system coords.System, frame *coords.Frame) error {
+    if raw, ok := fields["zones"]; ok && string(raw) != "null" {
+        var zones [][]float64
+        if err := json.Unmarshal(raw, &zones); err != nil {
+            return err
+        }
+
+        converted := make([][]int, len(zones))
+        for index, zone := range zones {
+            if len(zone) < 4 {
+                return fmt.Errorf("Zone %v has too few elements!", zone)
+            }
+
+            x1, y1, err := frame.ToRobot(system, zone[0], zone[1])
+            if err != nil {
+                return err
+            }
+
+            x2, y2, err := frame.ToRobot(system, zone[2], zone[3])
+            if err != nil {
+                return err
+            }
+
+            // Pixel coordinates flip the y axis
+            converted[index] = []int{minInt(x1, x2), minInt(y1, y2), maxInt(x1, x2), maxInt(y1, y2)}
+            for _, value := range zone[4:] {
+                converted[index] = append(converted[index], int(value))
+            }
+        }
+
+        var err error
+        if fields["zones"], err = json.Marshal(converted); err != nil {
+            return err
+        }
+    }
+
+    for _, field := range coordinateFields {
+        raw, ok := fields[field]
+        if !ok || string(raw) == "null" {
+            continue
+        }
+
+        var point []float64
+        if err := json.Unmarshal(raw, &point); err != nil {
+            return err
+        }
+
+        if len(point) != 2 {
+            return fmt.Errorf("%s %v is not [x,y]!", field, point)
+        }
+
+        x, y, err := frame.ToRobot(system, point[0], point[1])
+        if err != nil {
+            return err
+        }
+
+        if fields[field], err = json.Marshal([]int{x, y}); err != nil {
+            return err
+        }
+    }
+
+    for _, field := range nestedCoordinateFields {
+        raw, ok := fields[field]
+        if !ok || string(raw) == "null" {
+            continue
+        }
+
+        var elements []map[string]json.RawMessage
+        if err := json.Unmarshal(raw, &elements); err != nil {
+            return err
+        }
+
+        for index, element := range elements {
+            if err := convertFields(element, system, frame); err != nil {
+                return fmt.Errorf("%s %d: %s", field, index, err.Error())
+            }
+        }
+
+        var err error
+        if fields[field], err = json.Marshal(elements); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func minInt(a int, b int) int {
+    if a < b {
+        return a
+    }
+
+    return b
+}
+
+func maxInt(a int, b int) int {
+    if a > b {
+        return a
+    }
+
+    return b
+}
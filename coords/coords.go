@@ -0,0 +1,120 @@
+// Package coords converts between the coordinate systems used to describe
+// positions on the robot's map.
+//
+// Robot coordinates are millimetres as understood by the firmware. Pixel
+// coordinates address the rendered map image including its scale, origin in
+// the top left corner with y pointing down. Dock coordinates are metres
+// relative to the dock with y pointing up.
+package coords
+
+import (
+    "errors"
+    "math"
+
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+type System string
+
+const (
+    Robot System = "robot"
+    Pixel System = "pixel"
+    Dock System = "dock"
+)
+
+func ParseSystem(name string) (System, error) {
+    switch System(name) {
+    case "", Robot:
+        return Robot, nil
+    case Pixel, Dock:
+        return System(name), nil
+    }
+
+    return "", errors.New("Unknown coordinate system " + name + "!")
+}
+
+// Frame holds what is needed to convert between the systems: the position
+// of the map image and the dock.
+type Frame struct {
+    Left        int     `json:"left"`
+    Top         int     `json:"top"`
+    Width       int     `json:"width"`
+    Height      int     `json:"height"`
+    // mm per map pixel
+    Resolution  int     `json:"resolution"`
+    // Image pixels per map pixel, see rrmap.Renderer
+    Scale       int     `json:"scale"`
+    Dock        *rrmap.Pose `json:"dock"`
+}
+
+// NewFrame returns the frame of a parsed map rendered at scale. dock may be
+// nil.
+func NewFrame(m *rrmap.Map, dock *rrmap.Pose, scale int) Frame {
+    return Frame{
+        Left: m.Image.Left,
+        Top: m.Image.Top,
+        Width: m.Image.Width,
+        Height: m.Image.Height,
+        Resolution: rrmap.Resolution,
+        Scale: scale,
+        Dock: dock,
+    }
+}
+
+func (f Frame) scale() float64 {
+    if f.Scale < 1 {
+        return 1
+    }
+
+    return float64(f.Scale)
+}
+
+func (f Frame) check(system System) error {
+    switch system {
+    case Pixel:
+        if f.Resolution == 0 || f.Height == 0 {
+            return errors.New("No map to convert pixel coordinates!")
+        }
+    case Dock:
+        if f.Dock == nil {
+            return errors.New("No dock position to convert dock coordinates!")
+        }
+    }
+
+    return nil
+}
+
+// ToRobot converts a position given in system to robot coordinates.
+func (f Frame) ToRobot(system System, x float64, y float64) (int, int, error) {
+    if err := f.check(system); err != nil {
+        return 0, 0, err
+    }
+
+    switch system {
+    case Pixel:
+        x = (x / f.scale() + float64(f.Left)) * float64(f.Resolution)
+        y = (float64(f.Top + f.Height) - y / f.scale()) * float64(f.Resolution)
+    case Dock:
+        x = float64(f.Dock.X) + x * 1000
+        y = float64(f.Dock.Y) + y * 1000
+    }
+
+    return int(math.Round(x)), int(math.Round(y)), nil
+}
+
+// FromRobot converts robot coordinates to system.
+func (f Frame) FromRobot(system System, x int, y int) (float64, float64, error) {
+    if err := f.check(system); err != nil {
+        return 0, 0, err
+    }
+
+    switch system {
+    case Pixel:
+        return (float64(x) / float64(f.Resolution) - float64(f.Left)) * f.scale(),
+            (float64(f.Top + f.Height) - float64(y) / float64(f.Resolution)) * f.scale(), nil
+    case Dock:
+        return float64(x - f.Dock.X) / 1000, float64(y - f.Dock.Y) / 1000, nil
+    }
+
+    return float64(x), float64(y), nil
+}
@@ -0,0 +1,121 @@
+package coords
+
+import (
+    "math"
+    "testing"
+
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+var testFrame = Frame{
+    Left: 400,
+    Top: 420,
+    Width: 200,
+    Height: 180,
+    Resolution: 50,
+    Dock: &rrmap.Pose{X: 25500, Y: 24800},
+}
+
+func TestParseSystem(t *testing.T) {
+    for name, expected := range map[string]System{"": Robot, "robot": Robot, "pixel": Pixel, "dock": Dock} {
+        if system, err := ParseSystem(name); err != nil || system != expected {
+            t.Errorf("System %q parsed as %q (%v)", name, system, err)
+        }
+    }
+
+    if _, err := ParseSystem("gps"); err == nil {
+        t.Error("Unknown system accepted")
+    }
+}
+
+func TestToRobot(t *testing.T) {
+    tests := []struct {
+        system  System
+        x, y    float64
+        robotX  int
+        robotY  int
+    }{
+        {Robot, 25000, 26000, 25000, 26000},
+        // Top left and bottom left corner of the image
+        {Pixel, 0, 0, 20000, 30000},
+        {Pixel, 0, 180, 20000, 21000},
+        {Pixel, 100.5, 90, 25025, 25500},
+        {Dock, 0, 0, 25500, 24800},
+        {Dock, 1.5, -0.25, 27000, 24550},
+    }
+
+    for _, test := range tests {
+        x, y, err := testFrame.ToRobot(test.system, test.x, test.y)
+        if err != nil {
+            t.Errorf("%s %v/%v: %s", test.system, test.x, test.y, err.Error())
+            continue
+        }
+
+        if x != test.robotX || y != test.robotY {
+            t.Errorf("%s %v/%v: got %d/%d, expected %d/%d", test.system, test.x, test.y, x, y, test.robotX, test.robotY)
+        }
+    }
+}
+
+func TestScaledPixels(t *testing.T) {
+    frame := testFrame
+    frame.Scale = 2
+
+    // The bottom right corner of the image
+    if x, y, err := frame.ToRobot(Pixel, 400, 360); err != nil || x != 30000 || y != 21000 {
+        t.Errorf("Pixel 400/360 is %d/%d (%v)", x, y, err)
+    }
+
+    if x, y, err := frame.FromRobot(Pixel, 25025, 25500); err != nil || x != 201 || y != 180 {
+        t.Errorf("Robot 25025/25500 is pixel %v/%v (%v)", x, y, err)
+    }
+}
+
+func TestRoundTrip(t *testing.T) {
+    scaled := testFrame
+    scaled.Scale = 2
+
+    for _, frame := range []Frame{testFrame, scaled} {
+        for _, system := range []System{Robot, Pixel, Dock} {
+            for _, point := range [][2]int{{20000, 30000}, {25000, 25000}, {25025, 21000}, {51200, 0}} {
+                roundTrip(t, frame, system, point)
+            }
+        }
+    }
+}
+
+func roundTrip(t *testing.T, frame Frame, system System, point [2]int) {
+    t.Helper()
+
+    x, y, err := frame.FromRobot(system, point[0], point[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    robotX, robotY, err := frame.ToRobot(system, x, y)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if robotX != point[0] || robotY != point[1] {
+        t.Errorf("%s at scale %d: %v became %v/%v and %d/%d", system, frame.Scale, point, x, y, robotX, robotY)
+    }
+}
+
+func TestMissingFrame(t *testing.T) {
+    if _, _, err := (Frame{}).ToRobot(Pixel, 0, 0); err == nil {
+        t.Error("Pixel conversion without map accepted")
+    }
+
+    if _, _, err := (Frame{Resolution: 50, Height: 180}).FromRobot(Dock, 0, 0); err == nil {
+        t.Error("Dock conversion without dock accepted")
+    }
+
+    if x, y, err := (Frame{}).ToRobot(Robot, 1.4, 1.6); err != nil || x != 1 || y != 2 {
+        t.Errorf("Robot coordinates rounded to %d/%d (%v)", x, y, err)
+    }
+
+    if x, _, _ := testFrame.FromRobot(Dock, 25501, 0); math.Abs(x - 0.001) > 1e-9 {
+        t.Errorf("1 mm from the dock is %v m", x)
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CronSpec is a parsed five field cron expression:
+// minute hour day-of-month month day-of-week
+type CronSpec struct {
+    minute  uint64
+    hour    uint64
+    dom     uint64
+    month   uint64
+    dow     uint64
+
+    // Whether day-of-month/day-of-week have been restricted
+    domAny  bool
+    dowAny  bool
+}
+
+type cronField struct {
+    min int
+    max int
+}
+
+var cronFields = []cronField{
+    {0, 59},
+    {0, 23},
+    {1, 31},
+    {1, 12},
+    // 7 is Sunday as well
+    {0, 7},
+}
+
+func ParseCron(expression string) (*CronSpec, error) {
+    fields := strings.Fields(expression)
+    if len(fields) != len(cronFields) {
+        return nil, fmt.Errorf("Cron expression %q has %d fields, expected %d!", expression, len(fields), len(cronFields))
+    }
+
+    var bits [5]uint64
+    for index, field := range fields {
+        value, err := parseCronField(field, cronFields[index])
+        if err != nil {
+            return nil, fmt.Errorf("Cron expression %q: %s!", expression, err.Error())
+        }
+
+        bits[index] = value
+    }
+
+    // Sunday
+    if bits[4] & (1 << 7) != 0 {
+        bits[4] |= 1
+    }
+
+    return &CronSpec{
+        minute: bits[0],
+        hour: bits[1],
+        dom: bits[2],
+        month: bits[3],
+        dow: bits[4],
+        domAny: fields[2] == "*",
+        dowAny: fields[4] == "*",
+    }, nil
+}
+
+func parseCronField(field string, limits cronField) (uint64, error) {
+    var bits uint64
+
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        low, high := limits.min, limits.max
+
+        if index := strings.Index(part, "/"); index >= 0 {
+            value, err := strconv.Atoi(part[index + 1:])
+            if err != nil || value < 1 {
+                return 0, errors.New("invalid step in " + part)
+            }
+
+            step = value
+            part = part[:index]
+        }
+
+        if part != "*" {
+            bounds := strings.SplitN(part, "-", 2)
+
+            value, err := strconv.Atoi(bounds[0])
+            if err != nil {
+                return 0, errors.New("invalid value " + part)
+            }
+            low, high = value, value
+
+            if len(bounds) == 2 {
+                if high, err = strconv.Atoi(bounds[1]); err != nil {
+                    return 0, errors.New("invalid range " + part)
+                }
+            } else if step != 1 {
+                // 5/10 means 5-max/10
+                high = limits.max
+            }
+        }
+
+        if low < limits.min || high > limits.max || low > high {
+            return 0, fmt.Errorf("%s is out of range %d-%d", part, limits.min, limits.max)
+        }
+
+        for value := low; value <= high; value += step {
+            bits |= 1 << uint(value)
+        }
+    }
+
+    return bits, nil
+}
+
+func (spec *CronSpec) dayMatches(t time.Time) bool {
+    domMatch := spec.dom & (1 << uint(t.Day())) != 0
+    dowMatch := spec.dow & (1 << uint(t.Weekday())) != 0
+
+    // Like cron, restricting both fields means either one has to match
+    if !spec.domAny && !spec.dowAny {
+        return domMatch || dowMatch
+    }
+
+    return domMatch && dowMatch
+}
+
+// Matches reports whether the expression fires in the minute of t.
+func (spec *CronSpec) Matches(t time.Time) bool {
+    return spec.minute & (1 << uint(t.Minute())) != 0 &&
+        spec.hour & (1 << uint(t.Hour())) != 0 &&
+        spec.month & (1 << uint(t.Month())) != 0 &&
+        spec.dayMatches(t)
+}
+
+// Next returns the first time after t the expression fires. The zero time is
+// returned if there is none within the next five years.
+func (spec *CronSpec) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        if spec.month & (1 << uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+
+        if !spec.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+
+        if spec.hour & (1 << uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, t.Location())
+            continue
+        }
+
+        if spec.minute & (1 << uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+
+        return t
+    }
+
+    return time.Time{}
+}
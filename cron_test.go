@@ -0,0 +1,87 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+    invalid := []string{
+        "",
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * 32 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "5-1 * * * *",
+        "*/0 * * * *",
+        "a * * * *",
+        "1-b * * * *",
+        "1,,2 * * * *",
+    }
+
+    for _, expression := range invalid {
+        if _, err := ParseCron(expression); err == nil {
+            t.Errorf("Expression %q accepted", expression)
+        }
+    }
+}
+
+func TestCronNext(t *testing.T) {
+    // Wednesday
+    start := time.Date(2026, 1, 14, 10, 30, 0, 0, time.UTC)
+
+    tests := []struct {
+        expression  string
+        next        time.Time
+    }{
+        {"* * * * *", time.Date(2026, 1, 14, 10, 31, 0, 0, time.UTC)},
+        {"30 10 * * *", time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC)},
+        {"0 9,18 * * *", time.Date(2026, 1, 14, 18, 0, 0, 0, time.UTC)},
+        {"*/20 * * * *", time.Date(2026, 1, 14, 10, 40, 0, 0, time.UTC)},
+        {"5/20 * * * *", time.Date(2026, 1, 14, 10, 45, 0, 0, time.UTC)},
+        {"0 8-10 * * *", time.Date(2026, 1, 15, 8, 0, 0, 0, time.UTC)},
+        {"0 9 * * 1-5", time.Date(2026, 1, 15, 9, 0, 0, 0, time.UTC)},
+        // 0 and 7 are both Sunday
+        {"0 9 * * 0", time.Date(2026, 1, 18, 9, 0, 0, 0, time.UTC)},
+        {"0 9 * * 7", time.Date(2026, 1, 18, 9, 0, 0, 0, time.UTC)},
+        {"0 0 1 * *", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+        {"0 0 31 * *", time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)},
+        {"0 0 1 6 *", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)},
+        // Restricting both days means either one matches
+        {"0 12 20 * 5", time.Date(2026, 1, 16, 12, 0, 0, 0, time.UTC)},
+        {"0 12 15 * 1", time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)},
+        // Leap day
+        {"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+    }
+
+    for _, test := range tests {
+        spec, err := ParseCron(test.expression)
+        if err != nil {
+            t.Errorf("Expression %q rejected: %s", test.expression, err.Error())
+            continue
+        }
+
+        if next := spec.Next(start); !next.Equal(test.next) {
+            t.Errorf("Expression %q: next %s, expected %s", test.expression, next, test.next)
+        }
+
+        if !spec.Matches(test.next) {
+            t.Errorf("Expression %q does not match %s", test.expression, test.next)
+        }
+    }
+}
+
+func TestCronNextNever(t *testing.T) {
+    spec, err := ParseCron("0 0 31 2 *")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if next := spec.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+        t.Fatalf("February 31st at %s", next)
+    }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+const (
+    // Share of known cells that may differ before a restore gets refused
+    mapDriftMaxChanged = 0.1
+    // Distance the dock may move before a restore gets refused (mm)
+    mapDriftMaxDockMoved = 300
+)
+
+// MapDrift describes how far the live map moved away from the base map.
+type MapDrift struct {
+    Identical       bool        `json:"identical"`
+    // Cells that are floor or wall in either map
+    KnownCells      int         `json:"known_cells"`
+    ChangedCells    int         `json:"changed_cells"`
+    Changed         float64     `json:"changed"`
+    // Distance between the charger positions (mm)
+    DockMoved       *float64    `json:"dock_moved"`
+    // Also set if a map could not be compared
+    Significant     bool        `json:"significant"`
+    Error           *string     `json:"error"`
+}
+
+func (drift *MapDrift) String() string {
+    if drift.Identical {
+        return "identical"
+    }
+
+    if drift.Error != nil {
+        return "unknown, " + *drift.Error
+    }
+
+    dockMoved := "unknown"
+    if drift.DockMoved != nil {
+        dockMoved = fmt.Sprintf("%.0fmm", *drift.DockMoved)
+    }
+
+    return fmt.Sprintf("%.1f%% of the map changed, dock moved %s", drift.Changed * 100, dockMoved)
+}
+
+// compareMapImages counts the cells whose class differs between two maps,
+// the images are aligned by their absolute position.
+func compareMapImages(a *rrmap.Image, b *rrmap.Image) (int, int) {
+    left := a.Left
+    if b.Left < left {
+        left = b.Left
+    }
+
+    top := a.Top
+    if b.Top < top {
+        top = b.Top
+    }
+
+    right := a.Left + a.Width
+    if b.Left + b.Width > right {
+        right = b.Left + b.Width
+    }
+
+    bottom := a.Top + a.Height
+    if b.Top + b.Height > bottom {
+        bottom = b.Top + b.Height
+    }
+
+    known, changed := 0, 0
+    for y := top; y < bottom; y++ {
+        for x := left; x < right; x++ {
+            cellA := a.CellAt(x, y)
+            cellB := b.CellAt(x, y)
+
+            if cellA == rrmap.CellUnknown && cellB == rrmap.CellUnknown {
+                continue
+            }
+
+            known++
+            if cellA != cellB {
+                changed++
+            }
+        }
+    }
+
+    return known, changed
+}
+
+// computeMapDrift compares the map in live against the one in base.
+func computeMapDrift(live string, base string) (*MapDrift, error) {
+    drift := &MapDrift{Identical: true}
+
+    for _, file := range mapFiles {
+        liveHash, err := FileChecksum(live + file)
+        if err != nil {
+            return nil, err
+        }
+
+        baseHash, err := FileChecksum(base + file)
+        if err != nil {
+            return nil, err
+        }
+
+        if liveHash != baseHash {
+            drift.Identical = false
+        }
+    }
+
+    if drift.Identical {
+        return drift, nil
+    }
+
+    var errs []string
+
+    liveMap, err := rrmap.ReadFile(live + "last_map")
+    if err == nil {
+        var baseMap *rrmap.Map
+
+        if baseMap, err = rrmap.ReadFile(base + "last_map"); err == nil {
+            drift.KnownCells, drift.ChangedCells = compareMapImages(liveMap.Image, baseMap.Image)
+            if drift.KnownCells > 0 {
+                drift.Changed = float64(drift.ChangedCells) / float64(drift.KnownCells)
+            }
+        }
+    }
+
+    if err != nil {
+        errs = append(errs, "last_map: " + err.Error())
+    }
+
+    liveDock, err := rrmap.ReadPose(live + "ChargerPos.data")
+    if err == nil {
+        var baseDock *rrmap.Pose
+
+        if baseDock, err = rrmap.ReadPose(base + "ChargerPos.data"); err == nil {
+            moved := math.Round(liveDock.Distance(baseDock))
+            drift.DockMoved = &moved
+        }
+    }
+
+    if err != nil {
+        errs = append(errs, "ChargerPos.data: " + err.Error())
+    }
+
+    if len(errs) > 0 {
+        tmp := strings.Join(errs, ", "); drift.Error = &tmp
+    }
+
+    // Unknown drift is treated as significant, only a forced restore
+    // overwrites a map that could not be compared
+    drift.Significant = len(errs) > 0 || drift.Changed > mapDriftMaxChanged ||
+        (drift.DockMoved != nil && *drift.DockMoved > mapDriftMaxDockMoved)
+
+    return drift, nil
+}
+
+// checkMapDrift publishes the drift of the live map and fails if restoring
+// the base map would throw away a significantly different map.
+func checkMapDrift() (*MapDrift, error) {
+    drift, err := computeMapDrift(rockroboBasePath, baseMapPath())
+    if err != nil {
+        return nil, err
+    }
+
+    publishJSON(mapDriftTopic, true, drift)
+
+    if drift.Significant {
+        return drift, errors.New("Live map differs from the base map: " + drift.String() +
+            "! Save it or force the restore.")
+    }
+
+    return drift, nil
+}
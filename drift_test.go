@@ -0,0 +1,57 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func writeTestMapFiles(t *testing.T, directory string, contents string) {
+    for _, file := range mapFiles {
+        if err := ioutil.WriteFile(directory + file, []byte(contents), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestComputeMapDrift(t *testing.T) {
+    directory, err := ioutil.TempDir("", "drift")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(directory)
+
+    live, base := directory + "/live/", directory + "/base/"
+    for _, path := range []string{live, base} {
+        if err := os.Mkdir(path, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    writeTestMapFiles(t, live, "not a map")
+    writeTestMapFiles(t, base, "not a map")
+
+    drift, err := computeMapDrift(live, base)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !drift.Identical || drift.Significant {
+        t.Fatalf("Identical files: %+v", drift)
+    }
+
+    // Maps that cannot be compared must not be overwritten silently
+    writeTestMapFiles(t, live, "not a map either")
+
+    if drift, err = computeMapDrift(live, base); err != nil {
+        t.Fatal(err)
+    }
+
+    if drift.Identical || !drift.Significant || drift.Error == nil {
+        t.Fatalf("Unparsable maps: %+v", drift)
+    }
+
+    if _, err := computeMapDrift(live, directory + "/missing/"); err == nil {
+        t.Fatal("Missing base map accepted")
+    }
+}
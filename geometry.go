@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/novag/gen1_room_controller/coords"
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+// Idle points further away from the dock are most likely a mistake (mm)
+const idlePointMaxDockDistance = 3000
+
+// MapGeometry holds the dock and start pose of a map in robot coordinates.
+type MapGeometry struct {
+    Profile     string          `json:"profile"`
+    Dock        *rrmap.Pose     `json:"dock"`
+    Start       *rrmap.Pose     `json:"start"`
+    // Dock and start in pixels of the rendered map image
+    DockPixel   []float64       `json:"dock_pixel,omitempty"`
+    StartPixel  []float64       `json:"start_pixel,omitempty"`
+    Errors      []string        `json:"errors,omitempty"`
+}
+
+func readMapGeometry(directory string) *MapGeometry {
+    geometry := &MapGeometry{Profile: activeProfile()}
+
+    dock, err := rrmap.ReadPose(directory + "ChargerPos.data")
+    if err != nil {
+        geometry.Errors = append(geometry.Errors, "ChargerPos.data: " + err.Error())
+    }
+    geometry.Dock = dock
+
+    start, err := rrmap.ReadPose(directory + "StartPos.data")
+    if err != nil {
+        geometry.Errors = append(geometry.Errors, "StartPos.data: " + err.Error())
+    }
+    geometry.Start = start
+
+    return geometry
+}
+
+// publishMapGeometry publishes the geometry of the live map.
+func publishMapGeometry() {
+    geometry := readMapGeometry(rockroboBasePath)
+
+    if frame, err := coordinateFrame(); err != nil {
+        geometry.Errors = append(geometry.Errors, "last_map: " + err.Error())
+    } else {
+        geometry.DockPixel = pixelPosition(frame, geometry.Dock)
+        geometry.StartPixel = pixelPosition(frame, geometry.Start)
+    }
+
+    publishJSON(mapGeometryTopic, true, geometry)
+}
+
+func pixelPosition(frame coords.Frame, pose *rrmap.Pose) []float64 {
+    if pose == nil {
+        return nil
+    }
+
+    x, y, err := frame.FromRobot(coords.Pixel, pose.X, pose.Y)
+    if err != nil {
+        return nil
+    }
+
+    return []float64{x, y}
+}
+
+// checkIdlePoint warns about idle points implausibly far from the dock of
+// the base map the room's zones refer to.
+func checkIdlePoint(room Room) *string {
+    dock, err := rrmap.ReadPose(baseMapPath() + "ChargerPos.data")
+    if err != nil || len(room.IdlePoint) != 2 {
+        return nil
+    }
+
+    idlePoint := &rrmap.Pose{X: room.IdlePoint[0], Y: room.IdlePoint[1]}
+
+    distance := idlePoint.Distance(dock)
+    if distance <= idlePointMaxDockDistance {
+        return nil
+    }
+
+    warning := fmt.Sprintf("Idle point of room %s is %.0fmm away from the dock at %d, %d!",
+        room.Name, distance, dock.X, dock.Y)
+
+    return &warning
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Minimal iCalendar (RFC 5545) reader, only what is needed for VEVENTs.
+
+type icalProperty struct {
+    Name    string
+    Params  map[string]string
+    Value   string
+}
+
+type icalEvent struct {
+    UID         string
+    Summary     string
+    Start       time.Time
+    End         time.Time
+    // DTSTART was a date without time
+    AllDay      bool
+    // Time zone of DTSTART, Start itself is in local time
+    Location    *time.Location
+    Rule        *RRule
+    Transparent bool
+    Busy        bool
+
+    props       map[string]icalProperty
+}
+
+// RRule is a subset of RFC 5545 recurrence rules.
+type RRule struct {
+    Freq        string          `json:"freq"`
+    Interval    int             `json:"interval"`
+    Count       int             `json:"count,omitempty"`
+    Until       time.Time       `json:"until,omitempty"`
+    ByDay       []time.Weekday  `json:"by_day,omitempty"`
+    ByMonthDay  []int           `json:"by_month_day,omitempty"`
+}
+
+var icalWeekdays = map[string]time.Weekday{
+    "SU": time.Sunday,
+    "MO": time.Monday,
+    "TU": time.Tuesday,
+    "WE": time.Wednesday,
+    "TH": time.Thursday,
+    "FR": time.Friday,
+    "SA": time.Saturday,
+}
+
+// Joins folded lines.
+func unfoldICal(data string) []string {
+    var lines []string
+
+    data = strings.Replace(data, "\r\n", "\n", -1)
+    for _, line := range strings.Split(data, "\n") {
+        if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+            lines[len(lines) - 1] += line[1:]
+            continue
+        }
+
+        if line != "" {
+            lines = append(lines, line)
+        }
+    }
+
+    return lines
+}
+
+func parseICalProperty(line string) (icalProperty, error) {
+    prop := icalProperty{Params: map[string]string{}}
+
+    // Parameter values may be quoted and contain colons
+    quoted := false
+    colon := -1
+    for index, char := range line {
+        if char == '"' {
+            quoted = !quoted
+        } else if char == ':' && !quoted {
+            colon = index
+            break
+        }
+    }
+
+    if colon < 0 {
+        return prop, errors.New("missing value in line " + line)
+    }
+
+    prop.Value = line[colon + 1:]
+
+    parts := strings.Split(line[:colon], ";")
+    prop.Name = strings.ToUpper(parts[0])
+    for _, param := range parts[1:] {
+        pair := strings.SplitN(param, "=", 2)
+        if len(pair) == 2 {
+            prop.Params[strings.ToUpper(pair[0])] = strings.Trim(pair[1], `"`)
+        }
+    }
+
+    return prop, nil
+}
+
+func unescapeICalText(value string) string {
+    return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// Returns the time in its own time zone. Floating times and unknown time zones
+// are interpreted in local time.
+func parseICalTime(prop icalProperty) (time.Time, bool, error) {
+    value := prop.Value
+
+    if prop.Params["VALUE"] == "DATE" || len(value) == 8 {
+        t, err := time.ParseInLocation("20060102", value, time.Local)
+        return t, true, err
+    }
+
+    if strings.HasSuffix(value, "Z") {
+        t, err := time.Parse("20060102T150405Z", value)
+        return t, false, err
+    }
+
+    location := time.Local
+    if tzid, ok := prop.Params["TZID"]; ok {
+        if loc, err := time.LoadLocation(tzid); err == nil {
+            location = loc
+        }
+    }
+
+    t, err := time.ParseInLocation("20060102T150405", value, location)
+    return t, false, err
+}
+
+// Only simple durations like PT1H30M or P1D are supported.
+func parseICalDuration(value string) (time.Duration, error) {
+    var duration time.Duration
+    var number string
+    inTime := false
+
+    if !strings.HasPrefix(value, "P") {
+        return 0, errors.New("invalid duration " + value)
+    }
+
+    for _, char := range value[1:] {
+        if char >= '0' && char <= '9' {
+            number += string(char)
+            continue
+        }
+
+        if char == 'T' {
+            inTime = true
+            continue
+        }
+
+        n, err := strconv.Atoi(number)
+        if err != nil {
+            return 0, errors.New("invalid duration " + value)
+        }
+        number = ""
+
+        switch {
+        case char == 'W':
+            duration += time.Duration(n) * 7 * 24 * time.Hour
+        case char == 'D':
+            duration += time.Duration(n) * 24 * time.Hour
+        case char == 'H' && inTime:
+            duration += time.Duration(n) * time.Hour
+        case char == 'M' && inTime:
+            duration += time.Duration(n) * time.Minute
+        case char == 'S' && inTime:
+            duration += time.Duration(n) * time.Second
+        default:
+            return 0, errors.New("invalid duration " + value)
+        }
+    }
+
+    return duration, nil
+}
+
+func ParseRRule(value string) (*RRule, error) {
+    rule := &RRule{Interval: 1}
+
+    for _, part := range strings.Split(value, ";") {
+        pair := strings.SplitN(part, "=", 2)
+        if len(pair) != 2 {
+            return nil, errors.New("invalid rule part " + part)
+        }
+
+        var err error
+        switch strings.ToUpper(pair[0]) {
+        case "FREQ":
+            rule.Freq = strings.ToUpper(pair[1])
+        case "INTERVAL":
+            rule.Interval, err = strconv.Atoi(pair[1])
+        case "COUNT":
+            rule.Count, err = strconv.Atoi(pair[1])
+        case "UNTIL":
+            rule.Until, _, err = parseICalTime(icalProperty{Value: pair[1], Params: map[string]string{}})
+            rule.Until = rule.Until.Local()
+        case "BYDAY":
+            for _, day := range strings.Split(pair[1], ",") {
+                weekday, ok := icalWeekdays[strings.ToUpper(day)]
+                if !ok {
+                    return nil, errors.New("unsupported BYDAY value " + day)
+                }
+
+                rule.ByDay = append(rule.ByDay, weekday)
+            }
+        case "BYMONTHDAY":
+            for _, day := range strings.Split(pair[1], ",") {
+                n, err := strconv.Atoi(day)
+                if err != nil || n < 1 || n > 31 {
+                    return nil, errors.New("unsupported BYMONTHDAY value " + day)
+                }
+
+                rule.ByMonthDay = append(rule.ByMonthDay, n)
+            }
+        case "WKST":
+        default:
+            return nil, errors.New("unsupported rule part " + pair[0])
+        }
+
+        if err != nil {
+            return nil, errors.New("invalid rule part " + part)
+        }
+    }
+
+    switch rule.Freq {
+    case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+    default:
+        return nil, errors.New("unsupported frequency " + rule.Freq)
+    }
+
+    if rule.Interval < 1 {
+        return nil, fmt.Errorf("invalid interval %d", rule.Interval)
+    }
+
+    return rule, nil
+}
+
+// Occurrences calls fn with the start of every occurrence from start on until
+// fn returns false.
+func (rule *RRule) Occurrences(start time.Time, fn func(t time.Time) bool) {
+    count := 0
+
+    emit := func(t time.Time) bool {
+        if !rule.Until.IsZero() && t.After(rule.Until) {
+            return false
+        }
+
+        if rule.Count > 0 && count >= rule.Count {
+            return false
+        }
+
+        count++
+        return fn(t)
+    }
+
+    for period := 0; ; period += rule.Interval {
+        var candidates []time.Time
+
+        switch rule.Freq {
+        case "DAILY":
+            candidates = []time.Time{start.AddDate(0, 0, period)}
+        case "WEEKLY":
+            if len(rule.ByDay) == 0 {
+                candidates = []time.Time{start.AddDate(0, 0, 7 * period)}
+                break
+            }
+
+            // Days of the week starting on the Monday of the period
+            weekStart := start.AddDate(0, 0, 7 * period - (int(start.Weekday()) + 6) % 7)
+            for offset := 0; offset < 7; offset++ {
+                t := weekStart.AddDate(0, 0, offset)
+                for _, weekday := range rule.ByDay {
+                    if t.Weekday() == weekday && !t.Before(start) {
+                        candidates = append(candidates, t)
+                    }
+                }
+            }
+        case "MONTHLY":
+            // Months without the day of DTSTART are skipped, not rolled over
+            days := append([]int{}, rule.ByMonthDay...)
+            if len(days) == 0 {
+                days = []int{start.Day()}
+            }
+            sort.Ints(days)
+
+            month := time.Date(start.Year(), start.Month() + time.Month(period), 1,
+                start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+            for _, day := range days {
+                t := month.AddDate(0, 0, day - 1)
+                if t.Month() == month.Month() && !t.Before(start) {
+                    candidates = append(candidates, t)
+                }
+            }
+        case "YEARLY":
+            // February 29th only recurs in leap years
+            if t := start.AddDate(period, 0, 0); t.Month() == start.Month() {
+                candidates = []time.Time{t}
+            }
+        }
+
+        for _, t := range candidates {
+            if !emit(t) {
+                return
+            }
+        }
+
+        // Guard against rules that never produce anything
+        if period > 10000 {
+            return
+        }
+    }
+}
+
+func parseICalEvent(props []icalProperty) (*icalEvent, error) {
+    event := &icalEvent{props: map[string]icalProperty{}}
+    for _, prop := range props {
+        event.props[prop.Name] = prop
+    }
+
+    event.UID = event.props["UID"].Value
+    event.Summary = unescapeICalText(event.props["SUMMARY"].Value)
+
+    dtstart, ok := event.props["DTSTART"]
+    if !ok {
+        return event, errors.New("missing DTSTART")
+    }
+
+    var err error
+    if event.Start, event.AllDay, err = parseICalTime(dtstart); err != nil {
+        return event, errors.New("invalid DTSTART " + dtstart.Value)
+    }
+
+    event.Location = event.Start.Location()
+    event.Start = event.Start.Local()
+
+    if dtend, ok := event.props["DTEND"]; ok {
+        if event.End, _, err = parseICalTime(dtend); err != nil {
+            return event, errors.New("invalid DTEND " + dtend.Value)
+        }
+
+        event.End = event.End.Local()
+    } else if duration, ok := event.props["DURATION"]; ok {
+        d, err := parseICalDuration(duration.Value)
+        if err != nil {
+            return event, err
+        }
+
+        event.End = event.Start.Add(d)
+    } else if event.AllDay {
+        event.End = event.Start.AddDate(0, 0, 1)
+    } else {
+        event.End = event.Start
+    }
+
+    if rrule, ok := event.props["RRULE"]; ok {
+        if event.Rule, err = ParseRRule(rrule.Value); err != nil {
+            return event, err
+        }
+    }
+
+    event.Transparent = strings.ToUpper(event.props["TRANSP"].Value) == "TRANSPARENT"
+
+    // Only explicitly busy events count, events are opaque by default
+    busyStatus := strings.ToUpper(event.props["X-MICROSOFT-CDO-BUSYSTATUS"].Value)
+    event.Busy = strings.ToUpper(event.props["TRANSP"].Value) == "OPAQUE" ||
+        busyStatus == "BUSY" || busyStatus == "OOF"
+
+    return event, nil
+}
+
+type icalParseError struct {
+    UID     string  `json:"uid"`
+    Summary string  `json:"summary"`
+    Error   string  `json:"error"`
+}
+
+// ParseICal returns the VEVENTs of a calendar. Events that could not be
+// parsed are returned separately.
+func ParseICal(data string) ([]*icalEvent, []icalParseError, error) {
+    var events []*icalEvent
+    var failed []icalParseError
+    var props []icalProperty
+    inEvent := false
+    found := false
+
+    for _, line := range unfoldICal(data) {
+        prop, err := parseICalProperty(line)
+        if err != nil {
+            continue
+        }
+
+        switch {
+        case prop.Name == "BEGIN" && strings.ToUpper(prop.Value) == "VCALENDAR":
+            found = true
+        case prop.Name == "BEGIN" && strings.ToUpper(prop.Value) == "VEVENT":
+            inEvent = true
+            props = nil
+        case prop.Name == "END" && strings.ToUpper(prop.Value) == "VEVENT":
+            inEvent = false
+
+            event, err := parseICalEvent(props)
+            if err != nil {
+                failed = append(failed, icalParseError{
+                    UID: event.UID,
+                    Summary: event.Summary,
+                    Error: err.Error(),
+                })
+                continue
+            }
+
+            events = append(events, event)
+        case inEvent:
+            props = append(props, prop)
+        }
+    }
+
+    if !found {
+        return nil, nil, errors.New("No VCALENDAR found!")
+    }
+
+    return events, failed, nil
+}
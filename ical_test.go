@@ -0,0 +1,270 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestParseICalProperty(t *testing.T) {
+    prop, err := parseICalProperty(`dtstart;TZID="Europe/Berlin:Test";VALUE=DATE-TIME:20260114T103000`)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if prop.Name != "DTSTART" || prop.Value != "20260114T103000" {
+        t.Fatalf("Parsed %+v", prop)
+    }
+
+    expected := map[string]string{"TZID": "Europe/Berlin:Test", "VALUE": "DATE-TIME"}
+    if !reflect.DeepEqual(prop.Params, expected) {
+        t.Fatalf("Parameters %v, expected %v", prop.Params, expected)
+    }
+
+    if _, err := parseICalProperty("SUMMARY"); err == nil {
+        t.Fatal("Property without value accepted")
+    }
+}
+
+func TestParseICalDuration(t *testing.T) {
+    tests := map[string]time.Duration{
+        "PT1H30M": 90 * time.Minute,
+        "P1D": 24 * time.Hour,
+        "P1W": 7 * 24 * time.Hour,
+        "P1DT2H": 26 * time.Hour,
+        "PT45S": 45 * time.Second,
+    }
+
+    for value, expected := range tests {
+        if duration, err := parseICalDuration(value); err != nil || duration != expected {
+            t.Errorf("Duration %s: %s (%v), expected %s", value, duration, err, expected)
+        }
+    }
+
+    for _, value := range []string{"1H", "PH", "P1H", "P1M", "PT1X"} {
+        if _, err := parseICalDuration(value); err == nil {
+            t.Errorf("Duration %s accepted", value)
+        }
+    }
+}
+
+func TestParseRRuleInvalid(t *testing.T) {
+    invalid := []string{
+        "",
+        "FREQ=HOURLY",
+        "FREQ=DAILY;INTERVAL=0",
+        "FREQ=DAILY;INTERVAL=x",
+        "FREQ=WEEKLY;BYDAY=1MO",
+        "FREQ=MONTHLY;BYMONTHDAY=-1",
+        "FREQ=MONTHLY;BYMONTHDAY=32",
+        "FREQ=DAILY;BYHOUR=9",
+        "FREQ=DAILY;COUNT",
+    }
+
+    for _, value := range invalid {
+        if _, err := ParseRRule(value); err == nil {
+            t.Errorf("Rule %q accepted", value)
+        }
+    }
+}
+
+func date(year int, month time.Month, day int) time.Time {
+    return time.Date(year, month, day, 9, 0, 0, 0, time.UTC)
+}
+
+func TestRRuleOccurrences(t *testing.T) {
+    tests := []struct {
+        rule        string
+        start       time.Time
+        expected    []time.Time
+    }{
+        {
+            "FREQ=DAILY;INTERVAL=2;COUNT=3",
+            date(2026, 1, 30),
+            []time.Time{date(2026, 1, 30), date(2026, 2, 1), date(2026, 2, 3)},
+        },
+        {
+            // Starts on a Wednesday, the Sunday closes the first week
+            "FREQ=WEEKLY;BYDAY=MO,SU",
+            date(2026, 1, 14),
+            []time.Time{date(2026, 1, 18), date(2026, 1, 19), date(2026, 1, 25), date(2026, 1, 26)},
+        },
+        {
+            "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,FR;WKST=MO",
+            date(2026, 1, 14),
+            []time.Time{date(2026, 1, 16), date(2026, 1, 27), date(2026, 1, 30), date(2026, 2, 10)},
+        },
+        {
+            "FREQ=WEEKLY",
+            date(2026, 12, 30),
+            []time.Time{date(2026, 12, 30), date(2027, 1, 6), date(2027, 1, 13)},
+        },
+        {
+            // Short months have no 31st
+            "FREQ=MONTHLY;BYMONTHDAY=31",
+            date(2026, 1, 1),
+            []time.Time{date(2026, 1, 31), date(2026, 3, 31), date(2026, 5, 31), date(2026, 7, 31)},
+        },
+        {
+            "FREQ=MONTHLY",
+            date(2026, 1, 31),
+            []time.Time{date(2026, 1, 31), date(2026, 3, 31), date(2026, 5, 31), date(2026, 7, 31)},
+        },
+        {
+            "FREQ=MONTHLY;BYMONTHDAY=15,1",
+            date(2026, 1, 10),
+            []time.Time{date(2026, 1, 15), date(2026, 2, 1), date(2026, 2, 15), date(2026, 3, 1)},
+        },
+        {
+            "FREQ=YEARLY",
+            date(2024, 2, 29),
+            []time.Time{date(2024, 2, 29), date(2028, 2, 29), date(2032, 2, 29)},
+        },
+        {
+            "FREQ=DAILY;UNTIL=20260116T090000Z",
+            date(2026, 1, 14),
+            []time.Time{date(2026, 1, 14), date(2026, 1, 15), date(2026, 1, 16)},
+        },
+    }
+
+    for _, test := range tests {
+        rule, err := ParseRRule(test.rule)
+        if err != nil {
+            t.Errorf("Rule %q rejected: %s", test.rule, err.Error())
+            continue
+        }
+
+        var occurrences []time.Time
+        rule.Occurrences(test.start, func(t time.Time) bool {
+            occurrences = append(occurrences, t)
+            return len(occurrences) < 10
+        })
+
+        if len(occurrences) > len(test.expected) {
+            occurrences = occurrences[:len(test.expected)]
+        }
+
+        if len(occurrences) != len(test.expected) {
+            t.Errorf("Rule %q: occurrences %v, expected %v", test.rule, occurrences, test.expected)
+            continue
+        }
+
+        for index, occurrence := range occurrences {
+            if !occurrence.Equal(test.expected[index]) {
+                t.Errorf("Rule %q: occurrences %v, expected %v", test.rule, occurrences, test.expected)
+                break
+            }
+        }
+    }
+}
+
+func TestParseICal(t *testing.T) {
+    data := "BEGIN:VCALENDAR\r\n" +
+        "BEGIN:VEVENT\r\n" +
+        "UID:kitchen\r\n" +
+        "SUMMARY:Clean the\r\n" +
+        "  kitchen\\, please\r\n" +
+        "DTSTART:20260114T090000Z\r\n" +
+        "DURATION:PT1H\r\n" +
+        "RRULE:FREQ=WEEKLY;BYDAY=MO,WE\r\n" +
+        "END:VEVENT\r\n" +
+        "BEGIN:VEVENT\r\n" +
+        "UID:holiday\r\n" +
+        "SUMMARY:Away\r\n" +
+        "DTSTART;VALUE=DATE:20260201\r\n" +
+        "TRANSP:OPAQUE\r\n" +
+        "END:VEVENT\r\n" +
+        "BEGIN:VEVENT\r\n" +
+        "UID:broken\r\n" +
+        "SUMMARY:Broken\r\n" +
+        "DTSTART:20260114T090000Z\r\n" +
+        "RRULE:FREQ=HOURLY\r\n" +
+        "END:VEVENT\r\n" +
+        "END:VCALENDAR\r\n"
+
+    events, failed, err := ParseICal(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(events) != 2 {
+        t.Fatalf("Parsed %d events, expected 2", len(events))
+    }
+
+    kitchen := events[0]
+    if kitchen.UID != "kitchen" || kitchen.Summary != "Clean the kitchen, please" {
+        t.Errorf("Parsed %q/%q", kitchen.UID, kitchen.Summary)
+    }
+
+    start := time.Date(2026, 1, 14, 9, 0, 0, 0, time.UTC)
+    if !kitchen.Start.Equal(start) || !kitchen.End.Equal(start.Add(time.Hour)) {
+        t.Errorf("Event from %s to %s", kitchen.Start, kitchen.End)
+    }
+
+    if kitchen.Rule == nil || kitchen.Rule.Freq != "WEEKLY" || kitchen.AllDay || kitchen.Busy {
+        t.Errorf("Parsed %+v", kitchen)
+    }
+
+    holiday := events[1]
+    if !holiday.AllDay || !holiday.Busy || !holiday.End.Equal(holiday.Start.AddDate(0, 0, 1)) {
+        t.Errorf("Parsed %+v", holiday)
+    }
+
+    if len(failed) != 1 || failed[0].UID != "broken" {
+        t.Errorf("Failed events %+v", failed)
+    }
+
+    if _, _, err := ParseICal("BEGIN:VEVENT\nEND:VEVENT\n"); err == nil {
+        t.Error("Calendar without VCALENDAR accepted")
+    }
+}
+
+func TestICalCronTimeZone(t *testing.T) {
+    berlin, err := time.LoadLocation("Europe/Berlin")
+    if err != nil {
+        t.Skip(err)
+    }
+
+    previous := time.Local
+    time.Local = berlin
+    defer func() { time.Local = previous }()
+
+    tests := []struct {
+        dtstart     string
+        expression  string
+    }{
+        {"DTSTART:20260112T093000", "30 9 * * 1"},
+        {"DTSTART;TZID=Europe/Berlin:20260112T093000", "30 9 * * 1"},
+        // Switches daylight saving time on the same days
+        {"DTSTART;TZID=Europe/London:20260112T093000", "30 10 * * 1"},
+        {"DTSTART;TZID=America/New_York:20260112T093000", ""},
+        {"DTSTART:20260112T093000Z", ""},
+    }
+
+    for _, test := range tests {
+        data := "BEGIN:VCALENDAR\n" +
+            "BEGIN:VEVENT\n" +
+            test.dtstart + "\n" +
+            "RRULE:FREQ=WEEKLY\n" +
+            "END:VEVENT\n" +
+            "END:VCALENDAR\n"
+
+        events, _, err := ParseICal(data)
+        if err != nil || len(events) != 1 {
+            t.Fatalf("%s: %d events (%v)", test.dtstart, len(events), err)
+        }
+
+        expression, err := icalCron(events[0])
+        if test.expression == "" {
+            if err == nil {
+                t.Errorf("%s: accepted as %q", test.dtstart, expression)
+            }
+
+            continue
+        }
+
+        if err != nil || expression != test.expression {
+            t.Errorf("%s: %q (%v), expected %q", test.dtstart, expression, err, test.expression)
+        }
+    }
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/benbjohnson/clock"
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+type JobState string
+
+const (
+    JobStateRunning JobState = "running"
+    JobStatePaused JobState = "paused"
+    JobStateDone JobState = "done"
+    JobStateFailed JobState = "failed"
+    JobStateCancelled JobState = "cancelled"
+    // Cancelled because a limit was reached
+    JobStateStopped JobState = "stopped"
+)
+
+type jobControl int
+
+const (
+    jobControlCancel jobControl = iota
+    jobControlPause
+    jobControlResume
+)
+
+var errJobCancelled = errors.New("Job cancelled!")
+
+// Job is a controller-driven task like a room clean. Only one job runs at a
+// time, it owns Vacuum.UpdateChan while running.
+type Job struct {
+    sync.Mutex
+
+    ID          string      `json:"id"`
+    Kind        string      `json:"kind"`
+    State       JobState    `json:"state"`
+    Error       *string     `json:"error"`
+    Started     time.Time   `json:"started"`
+    Finished    *time.Time  `json:"finished,omitempty"`
+    Limits      *JobLimits  `json:"limits,omitempty"`
+    StopReason  *string     `json:"stop_reason,omitempty"`
+
+    // Called after the robot got paused and before the job continues.
+    // Re-issues whatever the robot was doing.
+    OnResume    func() `json:"-"`
+
+    control     chan jobControl
+}
+
+type JobProgress struct {
+    Job         string      `json:"job"`
+    Progress    interface{} `json:"progress"`
+}
+
+type JobManager struct {
+    sync.Mutex
+
+    active      *Job
+    // When and of which kind the last job finished
+    finished    time.Time
+    finishedKind string
+}
+
+var Jobs = &JobManager{}
+var jobClock = clock.New()
+
+// Start runs fn as a new job in the background. The limits apply from the
+// start of the job.
+func (m *JobManager) Start(kind string, limits JobLimits, fn func(job *Job) error) (*Job, error) {
+    m.Lock()
+    defer m.Unlock()
+
+    if m.active != nil {
+        return nil, errors.New("Job " + m.active.ID + " is still running!")
+    }
+
+    job := &Job{
+        ID: fmt.Sprintf("%x", jobClock.Now().UnixNano()),
+        Kind: kind,
+        State: JobStateRunning,
+        Started: jobClock.Now(),
+        control: make(chan jobControl, 10),
+    }
+
+    if !limits.empty() {
+        job.Limits = &limits
+    }
+
+    m.active = job
+
+    drainUpdates()
+    job.publishStatus()
+
+    go func() {
+        err := fn(job)
+
+        m.Lock()
+        m.active = nil
+        m.finished = jobClock.Now()
+        m.finishedKind = job.Kind
+        m.Unlock()
+
+        job.finish(err)
+    }()
+
+    return job, nil
+}
+
+func (m *JobManager) Active() *Job {
+    m.Lock()
+    defer m.Unlock()
+
+    return m.active
+}
+
+// RecentKind returns the kind of the running job or of the last job if it
+// finished within d, an empty string otherwise.
+func (m *JobManager) RecentKind(d time.Duration) string {
+    m.Lock()
+    defer m.Unlock()
+
+    if m.active != nil {
+        return m.active.Kind
+    }
+
+    if !m.finished.IsZero() && jobClock.Now().Sub(m.finished) < d {
+        return m.finishedKind
+    }
+
+    return ""
+}
+
+func (m *JobManager) lookup(id string) (*Job, error) {
+    job := m.Active()
+    if job == nil {
+        return nil, errors.New("No job running!")
+    }
+
+    // An empty ID addresses the active job
+    if id != "" && id != job.ID {
+        return nil, errors.New("Job " + id + " is not running!")
+    }
+
+    return job, nil
+}
+
+func (m *JobManager) Cancel(id string) error {
+    return m.send(id, jobControlCancel)
+}
+
+func (m *JobManager) Pause(id string) error {
+    return m.send(id, jobControlPause)
+}
+
+func (m *JobManager) Resume(id string) error {
+    return m.send(id, jobControlResume)
+}
+
+func (m *JobManager) send(id string, control jobControl) error {
+    job, err := m.lookup(id)
+    if err != nil {
+        return err
+    }
+
+    select {
+    case job.control <- control:
+    default:
+        return errors.New("Job " + job.ID + " is not responding!")
+    }
+
+    return nil
+}
+
+func (job *Job) finish(err error) {
+    now := jobClock.Now()
+
+    job.Lock()
+    job.Finished = &now
+
+    switch err {
+    case nil:
+        if job.StopReason != nil {
+            job.State = JobStateStopped
+        } else {
+            job.State = JobStateDone
+        }
+    case errJobCancelled:
+        if job.StopReason != nil {
+            job.State = JobStateStopped
+        } else {
+            job.State = JobStateCancelled
+        }
+    default:
+        job.State = JobStateFailed
+        tmp := err.Error(); job.Error = &tmp
+    }
+    job.Unlock()
+
+    fmt.Printf("Job %s %s.\n", job.ID, job.State)
+
+    job.publishStatus()
+}
+
+// stopped reports whether a limit ended the cleaning. Jobs skip their
+// remaining work and only dock.
+func (job *Job) stopped() bool {
+    job.Lock()
+    defer job.Unlock()
+
+    return job.StopReason != nil
+}
+
+func (job *Job) setState(state JobState) {
+    job.Lock()
+    job.State = state
+    job.Unlock()
+
+    job.publishStatus()
+}
+
+func (job *Job) publishStatus() {
+    job.Lock()
+    data, err := json.Marshal(job)
+    job.Unlock()
+
+    if err != nil {
+        fmt.Printf("publishStatus: %s\n", err.Error())
+        return
+    }
+
+    publish(jobStatusTopic, true, data)
+}
+
+func (job *Job) publishProgress(progress interface{}) {
+    data, err := json.Marshal(JobProgress{
+        Job: job.ID,
+        Progress: progress,
+    })
+    if err != nil {
+        fmt.Printf("publishProgress: %s\n", err.Error())
+        return
+    }
+
+    publish(jobProgressTopic, false, data)
+}
+
+func (job *Job) Control() <-chan jobControl {
+    return job.control
+}
+
+// poll handles pending control messages without waiting.
+func (job *Job) poll() error {
+    for {
+        select {
+        case control := <-job.control:
+            if err := job.handleControl(control); err != nil {
+                return err
+            }
+        default:
+            return nil
+        }
+    }
+}
+
+// handleControl processes a control message received by the job goroutine.
+// Pausing blocks until the job gets resumed or cancelled.
+func (job *Job) handleControl(control jobControl) error {
+    switch control {
+    case jobControlCancel:
+        return errJobCancelled
+    case jobControlPause:
+        Vacuum.PauseCleaning()
+        job.setState(JobStatePaused)
+
+        for control := range job.control {
+            switch control {
+            case jobControlCancel:
+                return errJobCancelled
+            case jobControlResume:
+                job.setState(JobStateRunning)
+
+                drainUpdates()
+                if job.OnResume != nil {
+                    job.OnResume()
+                }
+
+                return nil
+            }
+        }
+    }
+
+    return nil
+}
+
+// waitForState reads status updates until accept returns true. The timeout
+// does not run while the job is paused.
+func (job *Job) waitForState(accept func(state miio.VacState) bool, timeout time.Duration) error {
+    deadline := jobClock.Now().Add(timeout)
+    timer := jobClock.Timer(timeout)
+    defer func() { timer.Stop() }()
+
+    for {
+        select {
+        case update, ok := <-Vacuum.UpdateChan:
+            if !ok {
+                return errors.New("Update channel closed!")
+            }
+
+            if accept(update.State.State) {
+                return nil
+            }
+        case <-timer.C:
+            return fmt.Errorf("Timeout after %s!", timeout)
+        case control := <-job.control:
+            remaining := deadline.Sub(jobClock.Now())
+            timer.Stop()
+
+            if err := job.handleControl(control); err != nil {
+                return err
+            }
+
+            deadline = jobClock.Now().Add(remaining)
+            timer = jobClock.Timer(remaining)
+        }
+    }
+}
+
+// sleep waits for d, not counting the time the job is paused.
+func (job *Job) sleep(d time.Duration) error {
+    deadline := jobClock.Now().Add(d)
+    timer := jobClock.Timer(d)
+    defer func() { timer.Stop() }()
+
+    for {
+        select {
+        case <-Vacuum.UpdateChan:
+            // Not of interest, keeps the channel from filling up
+        case <-timer.C:
+            return nil
+        case control := <-job.control:
+            remaining := deadline.Sub(jobClock.Now())
+            timer.Stop()
+
+            if err := job.handleControl(control); err != nil {
+                return err
+            }
+
+            deadline = jobClock.Now().Add(remaining)
+            timer = jobClock.Timer(remaining)
+        }
+    }
+}
+
+// Drops stale status updates.
+func drainUpdates() {
+    for {
+        select {
+        case <-Vacuum.UpdateChan:
+        default:
+            return
+        }
+    }
+}
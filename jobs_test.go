@@ -0,0 +1,39 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/benbjohnson/clock"
+)
+
+func TestJobManagerRecentKind(t *testing.T) {
+    mock := clock.NewMock()
+    previous := jobClock
+    jobClock = mock
+    defer func() { jobClock = previous }()
+
+    m := &JobManager{}
+    if kind := m.RecentKind(time.Minute); kind != "" {
+        t.Fatalf("Kind %q without any job", kind)
+    }
+
+    m.active = &Job{Kind: "goto"}
+    if kind := m.RecentKind(time.Minute); kind != "goto" {
+        t.Fatalf("Kind %q of the running job", kind)
+    }
+
+    m.active = nil
+    m.finished = mock.Now()
+    m.finishedKind = "clean_rooms"
+
+    mock.Add(59 * time.Second)
+    if kind := m.RecentKind(time.Minute); kind != "clean_rooms" {
+        t.Fatalf("Kind %q within the grace period", kind)
+    }
+
+    mock.Add(time.Second)
+    if kind := m.RecentKind(time.Minute); kind != "" {
+        t.Fatalf("Kind %q after the grace period", kind)
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const maxJobMinutes = 600
+
+// JobLimits end a cleaning run early, the robot gets sent home once one of
+// them is reached.
+type JobLimits struct {
+    // Cleaning time as reported by the robot
+    MaxMinutes  int     `json:"max_minutes,omitempty"`
+    MinBattery  int     `json:"min_battery,omitempty"`
+}
+
+// CleanRequest is the JSON form of clean. The plain form is the command.
+type CleanRequest struct {
+    JobLimits
+    Command     string  `json:"command"`
+}
+
+func (limits JobLimits) Validate() error {
+    if limits.MaxMinutes < 0 || limits.MaxMinutes > maxJobMinutes {
+        return fmt.Errorf("max_minutes must be between 0 and %d!", maxJobMinutes)
+    }
+
+    if limits.MinBattery < 0 || limits.MinBattery > 100 {
+        return errors.New("min_battery must be between 0 and 100!")
+    }
+
+    return nil
+}
+
+func (limits JobLimits) empty() bool {
+    return limits.MaxMinutes == 0 && limits.MinBattery == 0
+}
+
+// reached returns why a limit stops the run, or an empty string.
+func (limits JobLimits) reached(state *miio.VacuumState) string {
+    if limits.MaxMinutes != 0 && state.CleanTime >= limits.MaxMinutes * 60 {
+        return fmt.Sprintf("max_minutes: cleaned for %d minutes", state.CleanTime / 60)
+    }
+
+    if limits.MinBattery != 0 && state.Battery < limits.MinBattery {
+        return fmt.Sprintf("min_battery: battery at %d%%", state.Battery)
+    }
+
+    return ""
+}
+
+// checkJobLimits must be called with every status update. Once a limit of
+// the active job is reached the robot stops cleaning and heads home, the job
+// itself carries on with its docking procedure.
+func checkJobLimits(state *miio.VacuumState) {
+    switch state.State {
+    case miio.VacStateCleaning, miio.VacStateZoneClean, miio.VacStateSpot:
+    default:
+        return
+    }
+
+    job := Jobs.Active()
+    if job == nil {
+        return
+    }
+
+    job.Lock()
+    if job.Limits == nil || job.StopReason != nil {
+        job.Unlock()
+        return
+    }
+
+    reason := job.Limits.reached(state)
+    if reason == "" {
+        job.Unlock()
+        return
+    }
+
+    job.StopReason = &reason
+    job.Unlock()
+
+    fmt.Printf("Stopping cleaning of job %s, limit reached: %s.\n", job.ID, reason)
+
+    mapVersions.interrupt(reason)
+    Vacuum.StopCleaningAndDock()
+}
+
+// startFullClean runs app_start as a job so that limits apply.
+func startFullClean(limits JobLimits) (*Job, error) {
+    if err := limits.Validate(); err != nil {
+        return nil, err
+    }
+
+    return Jobs.Start("clean", limits, func(job *Job) error {
+        job.OnResume = func() {
+            Vacuum.StartCleaning()
+        }
+
+        Vacuum.StartCleaning()
+
+        started := false
+
+        return job.waitForState(func(state miio.VacState) bool {
+            switch state {
+            case miio.VacStateCleaning:
+                started = true
+            case miio.VacStateReturning, miio.VacStateIdle, miio.VacStateCharging:
+                return started
+            }
+
+            return false
+        }, defaultRecoveryTimeouts[recoveryStateCleaning])
+    })
+}
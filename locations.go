@@ -0,0 +1,214 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+// Trips not ending within this time fail
+const tripTimeout = 10 * time.Minute
+
+// Location is a named point on the map, e.g. where the bin gets emptied.
+type Location struct {
+    Name    string          `json:"name"`
+    Point   Coordinates     `json:"point"`
+}
+
+// TripResult is published on the status topic of the command once the robot
+// arrived or gave up.
+type TripResult struct {
+    Job         string          `json:"job"`
+    Location    string          `json:"location,omitempty"`
+    Target      Coordinates     `json:"target"`
+    Arrived     bool            `json:"arrived"`
+}
+
+var locationsMutex sync.Mutex
+var locations = map[string]Location{}
+// Locations of the active profile
+var locationsPath string
+
+func validatePoint(point Coordinates) error {
+    if len(point) != 2 {
+        return fmt.Errorf("Point %v is not [x,y]!", []int(point))
+    }
+
+    for _, value := range point {
+        if value < mapMinCoordinate || value > mapMaxCoordinate {
+            return fmt.Errorf("Point %v is outside of the map!", []int(point))
+        }
+    }
+
+    return nil
+}
+
+func loadLocations(path string) error {
+    stored := map[string]Location{}
+
+    if err := ReadJSONFile(path, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    locationsMutex.Lock()
+    locations = stored
+    locationsPath = path
+    locationsMutex.Unlock()
+
+    return nil
+}
+
+func getLocation(name string) (Location, error) {
+    locationsMutex.Lock()
+    defer locationsMutex.Unlock()
+
+    location, ok := locations[name]
+    if !ok {
+        return Location{}, errors.New("Unknown location " + name + "!")
+    }
+
+    return location, nil
+}
+
+func listLocations() []Location {
+    locationsMutex.Lock()
+    defer locationsMutex.Unlock()
+
+    list := make([]Location, 0, len(locations))
+    for _, location := range locations {
+        list = append(list, location)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+func setLocation(location Location) error {
+    if location.Name == "" {
+        return errors.New("Location without name!")
+    }
+
+    if err := validatePoint(location.Point); err != nil {
+        return err
+    }
+
+    if err := checkNoGo(location.Point[0], location.Point[1]); err != nil {
+        return err
+    }
+
+    locationsMutex.Lock()
+    defer locationsMutex.Unlock()
+
+    previous, existed := locations[location.Name]
+    locations[location.Name] = location
+
+    if err := WriteJSONFile(locationsPath, locations); err != nil {
+        if existed {
+            locations[location.Name] = previous
+        } else {
+            delete(locations, location.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteLocation(name string) error {
+    locationsMutex.Lock()
+    defer locationsMutex.Unlock()
+
+    location, ok := locations[name]
+    if !ok {
+        return errors.New("Unknown location " + name + "!")
+    }
+
+    delete(locations, name)
+    if err := WriteJSONFile(locationsPath, locations); err != nil {
+        locations[name] = location
+        return err
+    }
+
+    return nil
+}
+
+// waitArrival waits for the robot to go from VacStateGoTo to idle.
+func waitArrival(job *Job) error {
+    started := false
+    var failed *miio.VacState
+
+    err := job.waitForState(func(state miio.VacState) bool {
+        switch state {
+        case miio.VacStateGoTo:
+            started = true
+        case miio.VacStateIdle:
+            return started
+        default:
+            if started {
+                failed = &state
+                return true
+            }
+        }
+
+        return false
+    }, tripTimeout)
+
+    if err == nil && failed != nil {
+        err = fmt.Errorf("Trip ended in state %d!", *failed)
+    }
+
+    return err
+}
+
+// driveTo sends the robot to target and waits for it to arrive.
+func driveTo(job *Job, target Coordinates) error {
+    job.OnResume = func() {
+        Vacuum.GotoTarget(target[0], target[1])
+    }
+
+    if err := gotoTarget(target[0], target[1]); err != nil {
+        return err
+    }
+
+    return waitArrival(job)
+}
+
+// startTrip sends the robot to target as a job. The outcome is published on
+// statusTopic when the trip ends.
+func startTrip(target Coordinates, location string, statusTopic string) (*Job, error) {
+    if err := validatePoint(target); err != nil {
+        return nil, err
+    }
+
+    if err := checkNoGo(target[0], target[1]); err != nil {
+        return nil, err
+    }
+
+    return Jobs.Start("goto", JobLimits{}, func(job *Job) error {
+        err := driveTo(job, target)
+
+        result := TripResult{
+            Job: job.ID,
+            Location: location,
+            Target: target,
+            Arrived: err == nil,
+        }
+
+        if err == nil {
+            fmt.Println("Arrived at the target point.")
+        }
+
+        publishStatusResponse(MqttClient, statusTopic, result, err)
+
+        return err
+    })
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+    "bytes"
     "encoding/json"
     "errors"
     "fmt"
-    "io"
     "io/ioutil"
     "os"
     "os/exec"
     "os/signal"
     "strconv"
+    "strings"
     "sync"
     "syscall"
     "time"
@@ -22,319 +23,1063 @@ const (
     miioTokenPath = "/mnt/data/miio/device.token"
     rockroboBasePath = "/mnt/data/rockrobo/"
     roomControllerBasePath = "/mnt/data/room_controller/"
-    baseMapPath = roomControllerBasePath + "full/"
+    baseMapName = "full"
     sshPrivateKeyPath = "/root/.ssh/id_ed25519"
     sshPublicKeyPath = "/root/.ssh/id_ed25519.pub"
     sshKnownHostsPath = "/root/.ssh/known_hosts"
 
     statusUpdateTopic = "devices/vacuum/%s/status"
     pingTopic = "devices/vacuum/%s/ping"
+    activeRoomTopic = "devices/vacuum/%s/active_room"
+    jobStatusTopic = "devices/vacuum/%s/job/status"
+    jobProgressTopic = "devices/vacuum/%s/job/progress"
+    schedulesNextTopic = "devices/vacuum/%s/schedules/next"
+    schedulesRunTopic = "devices/vacuum/%s/schedules/run"
+    mapRestoreTopic = "devices/vacuum/%s/map/restore"
+    mapExportManifestTopic = "devices/vacuum/%s/maps/export/manifest"
+    mapExportChunkTopic = "devices/vacuum/%s/maps/export/chunk"
+    mapEventsTopic = "devices/vacuum/%s/maps/events"
+    mapDriftTopic = "devices/vacuum/%s/map/drift"
+    profileActiveTopic = "devices/vacuum/%s/profile/active"
+    mapGeometryTopic = "devices/vacuum/%s/map/geometry"
+    autoRestoreTopic = "devices/vacuum/%s/settings/auto_restore"
 )
 
 var subscriptions = map[string]MqttMsgHandler{
     "devices/vacuum/%s/save_map": saveMapMsgRcvd,
+    "devices/vacuum/%s/maps/list": mapsListMsgRcvd,
+    "devices/vacuum/%s/maps/inspect": mapsInspectMsgRcvd,
+    "devices/vacuum/%s/maps/rename": mapsRenameMsgRcvd,
+    "devices/vacuum/%s/maps/delete": mapsDeleteMsgRcvd,
+    "devices/vacuum/%s/maps/set_base": mapsSetBaseMsgRcvd,
+    "devices/vacuum/%s/maps/restore": mapsRestoreMsgRcvd,
+    "devices/vacuum/%s/maps/drift": mapsDriftMsgRcvd,
+    "devices/vacuum/%s/maps/render": mapsRenderMsgRcvd,
+    "devices/vacuum/%s/maps/export": mapsExportMsgRcvd,
+    "devices/vacuum/%s/maps/import/manifest": mapsImportManifestMsgRcvd,
+    "devices/vacuum/%s/maps/import/chunk": mapsImportChunkMsgRcvd,
+    "devices/vacuum/%s/maps/import/status": mapsImportStatusMsgRcvd,
     "devices/vacuum/%s/clean": cleanMsgRcvd,
     "devices/vacuum/%s/goto_target": gotoTargetMsgRcvd,
+    "devices/vacuum/%s/goto_location": gotoLocationMsgRcvd,
     "devices/vacuum/%s/clean_room": cleanRoomMsgRcvd,
+    "devices/vacuum/%s/clean_rooms": cleanRoomsMsgRcvd,
+
+    "devices/vacuum/%s/job/cancel": jobCancelMsgRcvd,
+    "devices/vacuum/%s/job/pause": jobPauseMsgRcvd,
+    "devices/vacuum/%s/job/resume": jobResumeMsgRcvd,
+
+    "devices/vacuum/%s/rooms/set": roomsSetMsgRcvd,
+    "devices/vacuum/%s/rooms/delete": roomsDeleteMsgRcvd,
+    "devices/vacuum/%s/rooms/list": roomsListMsgRcvd,
+    "devices/vacuum/%s/rooms/import": roomsImportMsgRcvd,
+
+    "devices/vacuum/%s/locations/set": locationsSetMsgRcvd,
+    "devices/vacuum/%s/locations/delete": locationsDeleteMsgRcvd,
+    "devices/vacuum/%s/locations/list": locationsListMsgRcvd,
+
+    "devices/vacuum/%s/recipes/set": recipesSetMsgRcvd,
+    "devices/vacuum/%s/recipes/delete": recipesDeleteMsgRcvd,
+    "devices/vacuum/%s/recipes/list": recipesListMsgRcvd,
+    "devices/vacuum/%s/recipes/run": recipesRunMsgRcvd,
+
+    "devices/vacuum/%s/routes/set": routesSetMsgRcvd,
+    "devices/vacuum/%s/routes/delete": routesDeleteMsgRcvd,
+    "devices/vacuum/%s/routes/list": routesListMsgRcvd,
+    "devices/vacuum/%s/routes/run": routesRunMsgRcvd,
+
+    "devices/vacuum/%s/nogo/set": noGoSetMsgRcvd,
+    "devices/vacuum/%s/nogo/delete": noGoDeleteMsgRcvd,
+    "devices/vacuum/%s/nogo/list": noGoListMsgRcvd,
+
+    "devices/vacuum/%s/profiles/set": profilesSetMsgRcvd,
+    "devices/vacuum/%s/profiles/delete": profilesDeleteMsgRcvd,
+    "devices/vacuum/%s/profiles/list": profilesListMsgRcvd,
+    "devices/vacuum/%s/profiles/select": profilesSelectMsgRcvd,
+
+    "devices/vacuum/%s/schedules/set": schedulesSetMsgRcvd,
+    "devices/vacuum/%s/schedules/delete": schedulesDeleteMsgRcvd,
+    "devices/vacuum/%s/schedules/list": schedulesListMsgRcvd,
+
+    "devices/vacuum/%s/calendar/import": calendarImportMsgRcvd,
+    "devices/vacuum/%s/calendar/blackouts": calendarBlackoutsMsgRcvd,
+
+    "devices/vacuum/%s/recovery/strategies": recoveryStrategiesMsgRcvd,
+    "devices/vacuum/%s/recovery/stats": recoveryStatsMsgRcvd,
+
+    "devices/vacuum/%s/settings/get": settingsGetMsgRcvd,
+    "devices/vacuum/%s/settings/set": settingsSetMsgRcvd,
 
     "devices/vacuum/%s/ssh/pubkey": sshPubKeyMsgRcvd,
     "devices/vacuum/%s/ssh/tunnel": sshTunnelMsgRcvd,
 }
 
-type MqttMsgHandler func(client mqtt.Client, message mqtt.Message) (*string, error)
+type MqttMsgHandler func(client mqtt.Client, message mqtt.Message) (interface{}, error)
+
+type Coordinates []int
+
+type Room struct {
+    Name        string      `json:"name"`
+    Zones       RoomZones   `json:"zones"`
+    IdlePoint   Coordinates `json:"idle_point"`
+    Strategy    string      `json:"strategy"`
+    // 0 keeps the current fan power
+    FanPower    int         `json:"fan_power,omitempty"`
+}
+
+// GotoTargetRequest is the object form of goto_target, it may name a
+// coordinate system. The plain form is [x,y] in robot coordinates.
+type GotoTargetRequest struct {
+    Target      Coordinates     `json:"target"`
+}
+
+type RoomProgress struct {
+    Room            string  `json:"room"`
+    Index           int     `json:"index"`
+    Count           int     `json:"count"`
+    // Zone batch of the room in progress
+    Batch           int     `json:"batch"`
+    Batches         int     `json:"batches"`
+    // Always false, the firmware does not report which zones of a zoned
+    // clean are done. Resuming restarts the whole batch.
+    ZoneProgress    bool    `json:"zone_progress"`
+}
+
+type RoomSetResult struct {
+    Warning     *string     `json:"warning"`
+}
+
+type AutoRestoreStatus struct {
+    Policy      string      `json:"policy"`
+    Grace       int         `json:"grace"`
+}
+
+type StatusRespone struct {
+    Error   *string     `json:"error"`
+    Data    interface{} `json:"data"`
+}
+
+type RemoteHost struct {
+    Address     string
+    Port        string
+    FetchKey    bool
+}
+
+var copyMapMutex sync.Mutex
+var Vacuum *miio.Vacuum
+var MqttClient mqtt.Client
+
+func publish(topic string, retained bool, payload interface{}) {
+    identifier, _ := GetIdentifier()
+
+    MqttClient.Publish(fmt.Sprintf(topic, identifier), 0, retained, payload)
+}
+
+func publishJSON(topic string, retained bool, v interface{}) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        fmt.Printf("publishJSON: %s\n", err.Error())
+        return
+    }
+
+    publish(topic, retained, data)
+}
+
+func checkDocked() error {
+    state := Vacuum.GetUpdateMessage().State.State
+
+    if state == miio.VacStateCharging || state == miio.VacStateFullyCharged {
+        return nil
+    }
+
+    return errors.New("Vacuum not docked! - State: " + strconv.Itoa(int(state)))
+}
+
+func checkAvailable() error {
+    state := Vacuum.GetUpdateMessage().State.State
+
+    if state == miio.VacStateCharging || state == miio.VacStateFullyCharged ||
+            state == miio.VacStateIdle || state == miio.VacStateSleeping ||
+            state == miio.VacStatePaused {
+        return nil;
+    }
+
+    return errors.New("Vacuum busy! - State: " + strconv.Itoa(int(state)))
+}
+
+func copyMapData(source string, destination string) (*MapCopyReport, error) {
+    // Only allow one call at a time
+    copyMapMutex.Lock()
+    defer copyMapMutex.Unlock()
+
+    if err := checkDocked(); err != nil {
+        return nil, err
+    }
+
+    return copyMapFiles(source, destination)
+}
+
+// restoreBaseMap refuses to overwrite a live map that drifted significantly
+// from the base map unless forced.
+func restoreBaseMap(force bool) error {
+    var source = baseMapPath()
+    var destination = rockroboBasePath
+
+    if !force {
+        drift, err := checkMapDrift()
+        if err != nil {
+            return err
+        }
+
+        if drift.Identical {
+            fmt.Println("Map has already been restored!")
+            return nil
+        }
+    }
+
+    fmt.Println("Restoring base map!")
+
+    report, err := copyMapData(source, destination)
+    if report != nil {
+        fmt.Printf("restoreBaseMap: %s\n", report)
+        publishJSON(mapRestoreTopic, false, report)
+    }
+
+    if err != nil {
+        if report != nil && report.RolledBack {
+            return fmt.Errorf("%s (%s)", err.Error(), report)
+        }
+
+        return err
+    }
+
+    if !report.Changed {
+        fmt.Println("Map has already been restored!")
+        return nil
+    }
+
+    cmd := exec.Command("service", "rrwatchdoge", "reload")
+    if err := cmd.Run(); err != nil {
+        return err
+    }
+
+    if err := waitReady(Vacuum, readinessTimeout()); err != nil {
+        return err
+    }
+
+    fmt.Println("Map restored!")
+
+    publishMapGeometry()
+
+    return nil
+}
+
+func gotoTarget(x int, y int) error {
+    if err := checkNoGo(x, y); err != nil {
+        return err
+    }
+
+    Vacuum.GotoTarget(x, y)
+
+    fmt.Println("Going to the target point.")
+
+    return nil
+}
+
+func waitZoneCleanFinished(job *Job, timeout time.Duration) error {
+    started := false
+
+    return job.waitForState(func(state miio.VacState) bool {
+        switch state {
+        case miio.VacStateZoneClean:
+            started = true
+        case miio.VacStateReturning, miio.VacStateIdle, miio.VacStateCharging:
+            return started
+        }
+
+        return false
+    }, timeout)
+}
+
+// jobFanPower changes the fan power while a job runs. restore puts the
+// setting from before the first change back.
+type jobFanPower struct {
+    previous    int
+    changed     bool
+}
+
+// set applies power, 0 keeps the current fan power.
+func (fan *jobFanPower) set(power int) {
+    if power == 0 {
+        return
+    }
+
+    if !fan.changed {
+        fan.previous = Vacuum.Snapshot().FanPower
+        fan.changed = true
+    }
+
+    Vacuum.SetFanPower(uint8(power))
+}
+
+func (fan *jobFanPower) restore() {
+    if !fan.changed || fan.previous == 0 {
+        return
+    }
+
+    Vacuum.SetFanPower(uint8(fan.previous))
+}
+
+// returnToDock waits for the last zones of room to be finished and docks.
+func returnToDock(job *Job, room Room, zones RoomZones) error {
+    strategy, err := getRecoveryStrategy(room.Strategy)
+    if err != nil {
+        return err
+    }
+
+    recovery := newDockRecovery(Vacuum, Vacuum.UpdateChan, jobClock, job, strategy, room.IdlePoint)
+    recovery.OnTransition = func(transition RecoveryTransition) {
+        job.publishProgress(transition)
+    }
+
+    // The recovery re-issues its own commands once it took over
+    job.OnResume = func() {
+        if recovery.State() != recoveryStateSettling && recovery.State() != recoveryStateCleaning {
+            return
+        }
+
+        if job.stopped() {
+            Vacuum.Dock()
+        } else {
+            Vacuum.ZonedClean(zones.Params())
+        }
+    }
+
+    state := recovery.Run()
+
+    recordRecoveryOutcome(strategy.Name, RecoveryOutcome{
+        Time: jobClock.Now(),
+        Room: room.Name,
+        Outcome: state,
+        Step: recovery.Step(),
+    })
+
+    switch state {
+    case recoveryStateDocked:
+        return nil
+    case recoveryStateCancelled:
+        return errJobCancelled
+    default:
+        return errors.New("Dock recovery failed!")
+    }
+}
+
+func roomName(room Room, index int) string {
+    if room.Name == "" {
+        return strconv.Itoa(index)
+    }
+
+    return room.Name
+}
+
+func cleanRoom(room Room, limits JobLimits) (*Job, error) {
+    return cleanRooms([]Room{room}, limits)
+}
+
+func cleanRooms(rooms []Room, limits JobLimits) (*Job, error) {
+    if len(rooms) == 0 {
+        return nil, errors.New("No rooms given!")
+    }
+
+    if err := checkBlackout(); err != nil {
+        return nil, err
+    }
+
+    // Zones with the no-go areas taken out
+    requested := rooms
+    rooms = make([]Room, len(requested))
+
+    for index, room := range requested {
+        if err := room.Validate(); err != nil {
+            return nil, fmt.Errorf("Room %s: %s", roomName(room, index), err.Error())
+        }
+
+        if room.Zones = applyNoGoAreas(room.Zones); len(room.Zones) == 0 {
+            return nil, fmt.Errorf("Room %s: All zones are within no-go areas!", roomName(room, index))
+        }
+
+        if err := room.Zones.Validate(); err != nil {
+            return nil, fmt.Errorf("Room %s: After subtracting no-go areas: %s", roomName(room, index), err.Error())
+        }
+
+        if len(room.IdlePoint) == 2 {
+            if err := checkNoGo(room.IdlePoint[0], room.IdlePoint[1]); err != nil {
+                return nil, fmt.Errorf("Room %s: Idle point %s", roomName(room, index), err.Error())
+            }
+        }
+
+        rooms[index] = room
+
+        strategy, err := getRecoveryStrategy(room.Strategy)
+        if err != nil {
+            return nil, fmt.Errorf("Room %s: %s", roomName(room, index), err.Error())
+        }
+
+        // Recovery goto steps do not go through gotoTarget and its no-go check
+        if err := strategy.checkNoGoPoints(room.IdlePoint); err != nil {
+            return nil, fmt.Errorf("Room %s: %s", roomName(room, index), err.Error())
+        }
+
+        if warning := checkIdlePoint(room); warning != nil {
+            fmt.Println("Warning: " + *warning)
+        }
+    }
+
+    return Jobs.Start("clean_rooms", limits, func(job *Job) error {
+        defer publish(activeRoomTopic, true, "")
+
+        var fan jobFanPower
+        defer fan.restore()
+
+        if err := restoreBaseMap(false); err != nil {
+            return err
+        }
+
+        var current Room
+        var batch RoomZones
+
+    rooms:
+        for index, room := range rooms {
+            name := roomName(room, index)
+            batches := room.Zones.Batches()
+
+            fan.set(room.FanPower)
+
+            for number, zones := range batches {
+                // A limit got reached, the robot is already on its way home
+                if job.stopped() {
+                    break rooms
+                }
+
+                current = room
+                batch = zones
+
+                if err := job.poll(); err != nil {
+                    return err
+                }
+
+                publish(activeRoomTopic, true, name)
+                job.publishProgress(RoomProgress{
+                    Room: name,
+                    Index: index,
+                    Count: len(rooms),
+                    Batch: number,
+                    Batches: len(batches),
+                })
+
+                // Finished batches are never re-issued. Within the batch
+                // the robot gives no progress, all of its zones get cleaned
+                // again.
+                job.OnResume = func() {
+                    Vacuum.ZonedClean(batch.Params())
+                }
+
+                Vacuum.ZonedClean(batch.Params())
+
+                fmt.Printf("Starting zoned clean of room %s, batch %d/%d.\n", name, number + 1, len(batches))
+
+                // Only the last batch of the last room ends with the docking procedure
+                if index < len(rooms) - 1 || number < len(batches) - 1 {
+                    if err := waitZoneCleanFinished(job, defaultRecoveryTimeouts[recoveryStateCleaning]); err != nil {
+                        return err
+                    }
+
+                    // Pausing before the next batch starts must not repeat this one
+                    job.OnResume = nil
+                }
+            }
+        }
+
+        return returnToDock(job, current, batch)
+    })
+}
+
+var saveMapMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkDocked(); err != nil {
+        return nil, err
+    }
+
+    metadata, err := saveMapSnapshot(string(message.Payload()))
+    if err != nil {
+        return nil, err
+    }
+
+    return metadata, nil
+}
+
+var mapsListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listMapSnapshots()
+}
+
+var mapsInspectMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return inspectMapSnapshot(string(message.Payload()))
+}
+
+var mapsRenameMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var request MapRenameRequest
+
+    if err := json.Unmarshal(message.Payload(), &request); err != nil {
+        return nil, err
+    }
+
+    if err := renameMapSnapshot(request.From, request.To); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
+}
+
+var mapsDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteMapSnapshot(string(message.Payload())); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
+}
+
+var mapsSetBaseMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := setBaseMapSnapshot(string(message.Payload())); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
+}
+
+var mapsRestoreMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkAvailable(); err != nil {
+        return nil, err
+    }
+
+    if err := restoreBaseMap(string(message.Payload()) == "force"); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
+}
+
+var mapsDriftMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    drift, err := computeMapDrift(rockroboBasePath, baseMapPath())
+    if err != nil {
+        return nil, err
+    }
+
+    publishJSON(mapDriftTopic, true, drift)
+
+    return drift, nil
+}
+
+var mapsRenderMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := renderMap(string(message.Payload())); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
+}
+
+var cleanMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkAvailable(); err != nil {
+        return nil, err
+    }
+
+    var request CleanRequest
+
+    payload := bytes.TrimSpace(message.Payload())
+    if len(payload) > 0 && payload[0] == '{' {
+        if err := json.Unmarshal(payload, &request); err != nil {
+            return nil, err
+        }
+    } else {
+        request.Command = string(payload)
+    }
+
+    command := request.Command
+    if command == "start" {
+        if err := checkBlackout(); err != nil {
+            return nil, err
+        }
+
+        if !request.JobLimits.empty() {
+            job, err := startFullClean(request.JobLimits)
+            if err != nil {
+                return nil, err
+            }
+
+            return &job.ID, nil
+        }
+
+        Vacuum.StartCleaning()
+    } else if command == "pause" {
+        // A running job pauses the robot itself
+        if Jobs.Active() == nil || Jobs.Pause("") != nil {
+            Vacuum.PauseCleaning()
+        }
+    } else {
+        // Keep the job from sending further commands
+        Jobs.Cancel("")
+        mapVersions.interrupt(command + " command")
+        Vacuum.StopCleaningAndDock()
+    }
+
+    return nil, nil
+}
+
+var gotoTargetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var request GotoTargetRequest
+
+    if err := checkAvailable(); err != nil {
+        return nil, err
+    }
+
+    payload := bytes.TrimSpace(message.Payload())
+    if len(payload) > 0 && payload[0] == '[' {
+        if err := json.Unmarshal(payload, &request.Target); err != nil {
+            return nil, err
+        }
+    } else if err := decodeWithCoordinates(payload, &request); err != nil {
+        return nil, err
+    }
+
+    job, err := startTrip(request.Target, "", message.Topic() + "/status")
+    if err != nil {
+        return nil, err
+    }
+
+    return &job.ID, nil
+}
+
+var gotoLocationMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkAvailable(); err != nil {
+        return nil, err
+    }
+
+    location, err := getLocation(string(message.Payload()))
+    if err != nil {
+        return nil, err
+    }
+
+    job, err := startTrip(location.Point, location.Name, message.Topic() + "/status")
+    if err != nil {
+        return nil, err
+    }
+
+    return &job.ID, nil
+}
+
+var cleanRoomMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var request CleanRoomRequest
+
+    if err := checkDocked(); err != nil {
+        return nil, err
+    }
+
+    if err := decodeWithCoordinates(message.Payload(), &request); err != nil {
+        return nil, err
+    }
+
+    room, err := request.resolve()
+    if err != nil {
+        return nil, err
+    }
+
+    if err := request.JobLimits.Validate(); err != nil {
+        return nil, err
+    }
+
+    job, err := cleanRoom(room, request.JobLimits)
+    if err != nil {
+        return nil, err
+    }
+
+    return &job.ID, nil
+}
+
+var cleanRoomsMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var requests []CleanRoomRequest
+
+    if err := checkDocked(); err != nil {
+        return nil, err
+    }
+
+    if err := decodeWithCoordinates(message.Payload(), &requests); err != nil {
+        return nil, err
+    }
+
+    rooms, err := resolveRooms(requests)
+    if err != nil {
+        return nil, err
+    }
+
+    job, err := cleanRooms(rooms, JobLimits{})
+    if err != nil {
+        return nil, err
+    }
+
+    return &job.ID, nil
+}
+
+var jobCancelMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := Jobs.Cancel(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-type Coordinates []int
+    mapVersions.interrupt("job cancelled")
+    Vacuum.StopCleaningAndDock()
 
-type Room struct {
-    Zones       RoomZones   `json:"zones"`
-    IdlePoint   Coordinates `json:"idle_point"`
+    return nil, nil
 }
 
-type RoomZones [][]int
+var jobPauseMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := Jobs.Pause(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-type StatusRespone struct {
-    Error   *string     `json:"error"`
-    Data    interface{} `json:"data"`
+    return nil, nil
 }
 
-type RemoteHost struct {
-    Address     string
-    Port        string
-    FetchKey    bool
+var jobResumeMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := Jobs.Resume(string(message.Payload())); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
 }
 
-var copyMapMutex sync.Mutex
-var Vacuum *miio.Vacuum
+var roomsSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var room Room
 
-func checkDocked() error {
-    state := Vacuum.GetUpdateMessage().State.State
+    if err := decodeWithCoordinates(message.Payload(), &room); err != nil {
+        return nil, err
+    }
 
-    if state == miio.VacStateCharging || state == miio.VacStateFullyCharged {
-        return nil
+    if err := setRoom(room); err != nil {
+        return nil, err
     }
 
-    return errors.New("Vacuum not docked! - State: " + strconv.Itoa(int(state)))
+    return RoomSetResult{Warning: checkIdlePoint(room)}, nil
 }
 
-func checkAvailable() error {
-    state := Vacuum.GetUpdateMessage().State.State
+var roomsDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteRoom(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-    if state == miio.VacStateCharging || state == miio.VacStateFullyCharged ||
-            state == miio.VacStateIdle || state == miio.VacStateSleeping ||
-            state == miio.VacStatePaused {
-        return nil;
+    return nil, nil
+}
+
+var roomsImportMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    result, err := importRoomPolygon(message.Payload())
+    if err != nil {
+        return nil, err
     }
 
-    return errors.New("Vacuum busy! - State: " + strconv.Itoa(int(state)))
+    return result, nil
 }
 
-func copyMapData(source string, destination string) (bool, error) {
-    fileFilter := []string{"last_map", "ChargerPos.data", "StartPos.data"}
+var roomsListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listRooms(), nil
+}
 
-    // Only allow one call at a time
-    copyMapMutex.Lock()
-    defer copyMapMutex.Unlock()
+var locationsSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var location Location
 
-    if err := checkDocked(); err != nil {
-        return false, err
+    if err := decodeWithCoordinates(message.Payload(), &location); err != nil {
+        return nil, err
     }
 
-    for index, file := range fileFilter {
-        sourceHash, err := FileChecksum(source + file)
-        if err != nil {
-            break
-        }
-
-        destinationHash, err := FileChecksum(destination + file)
-        if err != nil {
-            break
-        }
+    if err := setLocation(location); err != nil {
+        return nil, err
+    }
 
-        if sourceHash != destinationHash {
-            break
-        }
+    return nil, nil
+}
 
-        if index == len(fileFilter) - 1 {
-            return false, nil
-        }
+var locationsDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteLocation(string(message.Payload())); err != nil {
+        return nil, err
     }
 
-    os.MkdirAll(destination, os.ModePerm)
+    return nil, nil
+}
 
-    for _, file := range fileFilter {
-        srcFile, err := os.Open(source + file)
-        if err != nil {
-            return false, err
-        }
-        defer srcFile.Close()
+var locationsListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listLocations(), nil
+}
 
-        os.Remove(destination + file)
-        destFile, err := os.Create(destination + file)
-        if err != nil {
-            return false, err
-        }
-        defer destFile.Close()
+var recipesSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var recipe Recipe
 
-        if _, err = io.Copy(destFile, srcFile); err != nil {
-            return false, err
-        }
+    if err := decodeWithCoordinates(message.Payload(), &recipe); err != nil {
+        return nil, err
+    }
 
-        if err = destFile.Sync(); err != nil {
-            return false, err
-        }
+    if err := setRecipe(recipe); err != nil {
+        return nil, err
     }
 
-    return true, nil
+    return nil, nil
 }
 
-func restoreBaseMap() error {
-    var source = baseMapPath
-    var destination = rockroboBasePath
+var recipesDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteRecipe(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-    fmt.Println("Restoring base map!")
+    return nil, nil
+}
 
-    reload, err := copyMapData(source, destination)
-    if !reload {
-        if err == nil {
-            fmt.Println("Map has already been restored!")
-        }
+var recipesListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listRecipes(), nil
+}
 
-        return err
+var recipesRunMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkDocked(); err != nil {
+        return nil, err
     }
 
-    cmd := exec.Command("service", "rrwatchdoge", "reload")
-    if err := cmd.Run(); err != nil {
-        return err
+    job, err := runRecipe(string(message.Payload()))
+    if err != nil {
+        return nil, err
     }
 
-    time.Sleep(30 * time.Second)
+    return &job.ID, nil
+}
 
-    fmt.Println("Map restored!")
+var routesSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var route Route
 
-    return nil
+    if err := decodeWithCoordinates(message.Payload(), &route); err != nil {
+        return nil, err
+    }
+
+    if err := setRoute(route); err != nil {
+        return nil, err
+    }
+
+    return nil, nil
 }
 
-func gotoTarget(x int, y int) error {
-    Vacuum.GotoTarget(x, y)
+var routesDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteRoute(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-    fmt.Println("Going to the target point.")
+    return nil, nil
+}
 
-    return nil
+var routesListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listRoutes(), nil
 }
 
-func cleanRoom(zones RoomZones, idlePoint Coordinates) error {
-    if err := restoreBaseMap(); err != nil {
-        return err
+var routesRunMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := checkAvailable(); err != nil {
+        return nil, err
+    }
+
+    job, err := runRoute(string(message.Payload()))
+    if err != nil {
+        return nil, err
     }
 
-    Vacuum.ZonedClean(zones)
+    return &job.ID, nil
+}
+
+var noGoSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var area NoGoArea
 
-    fmt.Println("Starting zoned clean.")
+    if err := decodeWithCoordinates(message.Payload(), &area); err != nil {
+        return nil, err
+    }
 
-    go func() {
-        returnCount := 0
-        lastState := miio.VacStateZoneClean
+    if err := setNoGoArea(area); err != nil {
+        return nil, err
+    }
 
-        time.Sleep(30 * time.Second)
+    return nil, nil
+}
 
-        for {
-            state := (<-Vacuum.UpdateChan).State.State
+var noGoDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteNoGoArea(string(message.Payload())); err != nil {
+        return nil, err
+    }
 
-            // Done if charging
-            if state == miio.VacStateCharging {
-                fmt.Println("Charging. All done.")
-                return
-            }
+    return nil, nil
+}
 
-            if state == lastState {
-                continue
-            }
+var noGoListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listNoGoAreas(), nil
+}
 
-            fmt.Printf("Processing state: %d\n", state)
-
-            switch state {
-            case miio.VacStateReturning:
-                // expect { miio.VacStateIdle }
-            case miio.VacStateIdle:
-                switch returnCount {
-                case 0:
-                    // Dock not found
-                    time.Sleep(5 * time.Second)
-
-                    gotoTarget(idlePoint[0], idlePoint[1])
-
-                    // expect { miio.VacStateGoTo }
-                case 1:
-                    // Waiting for docking command
-
-                    // expect { miio.VacStateReturning }
-                case 2:
-                    // First orientation drive
-                    Vacuum.Dock()
-                    Vacuum.SetVolume(0)
-
-                    // expect { miio.VacStateReturning }
-                case 3:
-                    // Second orientation drive
-                    Vacuum.Dock()
-
-                    // expect { miio.VacStateReturning }
-                case 4:
-                    // We should have updated our map, going home now
-                    Vacuum.Dock()
-                    Vacuum.SetVolume(100)
-
-                    // expect { miio.VacStateReturning }
-                case 5:
-                    // Let's try one last time
-                    Vacuum.Dock()
-
-                    // expect { miio.VacStateReturning }
-                default:
-                    return
-                }
+var profilesSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var profile MapProfile
 
-                returnCount++
-            case miio.VacStateGoTo:
-                // expect { miio.VacStateIdle }
-            }
+    if err := json.Unmarshal(message.Payload(), &profile); err != nil {
+        return nil, err
+    }
 
-            lastState = state
-        }
-    }()
+    if err := setProfile(profile); err != nil {
+        return nil, err
+    }
 
-    return nil
+    return nil, nil
 }
 
-var saveMapMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
-    if err := checkDocked(); err != nil {
+var profilesDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteProfile(string(message.Payload())); err != nil {
         return nil, err
     }
 
-    var source = rockroboBasePath
-    var destination = roomControllerBasePath + string(message.Payload()) + "/"
+    return nil, nil
+}
+
+var profilesListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listProfiles(), nil
+}
 
-    if _, err := copyMapData(source, destination); err != nil {
+var profilesSelectMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := selectProfile(string(message.Payload())); err != nil {
         return nil, err
     }
 
     return nil, nil
 }
 
-var cleanMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
-    if err := checkAvailable(); err != nil {
+var settingsGetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return getSettings(), nil
+}
+
+var settingsSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    updated, err := updateSettings(message.Payload())
+    if err != nil {
         return nil, err
     }
 
-    command := string(message.Payload())
-    if command == "start" {
-        Vacuum.StartCleaning()
-    } else if command == "pause" {
-        Vacuum.PauseCleaning()
-    } else {
-        Vacuum.StopCleaningAndDock()
+    publishAutoRestore()
+
+    return updated, nil
+}
+
+var schedulesSetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var schedule Schedule
+
+    if err := json.Unmarshal(message.Payload(), &schedule); err != nil {
+        return nil, err
     }
 
+    if err := setSchedule(&schedule); err != nil {
+        return nil, err
+    }
+
+    publishNextScheduledRuns()
+
     return nil, nil
 }
 
-var gotoTargetMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
-    var coordinates Coordinates
-
-    if err := checkAvailable(); err != nil {
+var schedulesDeleteMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if err := deleteSchedule(string(message.Payload())); err != nil {
         return nil, err
     }
 
-    if err := json.Unmarshal(message.Payload(), &coordinates); err != nil {
+    publishNextScheduledRuns()
+
+    return nil, nil
+}
+
+var schedulesListMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listSchedules(), nil
+}
+
+var calendarImportMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return importCalendarPayload(string(message.Payload()))
+}
+
+var calendarBlackoutsMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    return listBlackouts(), nil
+}
+
+var recoveryStrategiesMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var strategies []RecoveryStrategy
+
+    // An empty payload queries the configured strategies
+    if len(message.Payload()) == 0 {
+        recoveryMutex.Lock()
+        defer recoveryMutex.Unlock()
+
+        return append([]RecoveryStrategy{builtinRecoveryStrategy}, recoveryStrategies...), nil
+    }
+
+    if err := json.Unmarshal(message.Payload(), &strategies); err != nil {
         return nil, err
     }
 
-    if err := gotoTarget(coordinates[0], coordinates[1]); err != nil {
+    if err := setRecoveryStrategies(strategies); err != nil {
         return nil, err
     }
 
     return nil, nil
 }
 
-var cleanRoomMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
-    var room Room
+var recoveryStatsMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    recoveryMutex.Lock()
+    defer recoveryMutex.Unlock()
 
-    if err := checkDocked(); err != nil {
+    data, err := json.Marshal(recoveryStats)
+    if err != nil {
         return nil, err
     }
 
-    if err := json.Unmarshal(message.Payload(), &room); err != nil {
+    return json.RawMessage(data), nil
+}
+
+var mapsExportMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var request MapExportRequest
+
+    if err := json.Unmarshal(message.Payload(), &request); err != nil {
+        // Plain map name
+        request = MapExportRequest{Name: string(message.Payload())}
+    }
+
+    return exportMapSnapshot(request)
+}
+
+var mapsImportManifestMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var manifest MapTransferManifest
+
+    if err := json.Unmarshal(message.Payload(), &manifest); err != nil {
         return nil, err
     }
 
-    if err := cleanRoom(room.Zones, room.IdlePoint); err != nil {
+    return startMapImport(manifest)
+}
+
+var mapsImportChunkMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    var chunk MapTransferChunk
+
+    if err := json.Unmarshal(message.Payload(), &chunk); err != nil {
         return nil, err
     }
-    
-    return nil, nil
+
+    return receiveMapChunk(chunk)
+}
+
+var mapsImportStatusMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
+    if len(message.Payload()) == 0 {
+        return listMapImports()
+    }
+
+    return getMapImportStatus(string(message.Payload()))
 }
 
-var sshPubKeyMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
+var sshPubKeyMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
     os.Remove(sshPrivateKeyPath)
     os.Remove(sshPublicKeyPath)
     cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", sshPrivateKeyPath, "-C", "vacuum_1", "-q", "-N", "")
@@ -352,7 +1097,7 @@ var sshPubKeyMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string,
     return &str_data, nil
 }
 
-var sshTunnelMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string, error) {
+var sshTunnelMsgRcvd = func(client mqtt.Client, message mqtt.Message) (interface{}, error) {
     var remoteHost RemoteHost
 
     if err := json.Unmarshal(message.Payload(), &remoteHost); err != nil {
@@ -381,12 +1126,10 @@ var sshTunnelMsgRcvd = func(client mqtt.Client, message mqtt.Message) (*string,
     return nil, nil
 }
 
-var mqttMsgRcvd = func(client mqtt.Client, message mqtt.Message) {
+// publishStatusResponse answers a command on its status topic.
+func publishStatusResponse(client mqtt.Client, topic string, data interface{}, err error) {
     var str_error *string
 
-    fmt.Println("MQTT message received!")
-
-    data, err := subscriptions[message.Topic()](client, message)
     if err != nil {
         tmp := err.Error(); str_error = &tmp
     }
@@ -398,11 +1141,23 @@ var mqttMsgRcvd = func(client mqtt.Client, message mqtt.Message) {
 
     jdata, err := json.Marshal(statusResponse)
     if err != nil {
-        client.Publish(message.Topic() + "/status", 0, false, `{"error":"` + err.Error() + `","data":null}`)
+        client.Publish(topic, 0, false, `{"error":"` + err.Error() + `","data":null}`)
         return
     }
 
-    client.Publish(message.Topic() + "/status", 0, false, string(jdata))
+    client.Publish(topic, 0, false, string(jdata))
+}
+
+var mqttMsgRcvd = func(client mqtt.Client, message mqtt.Message) {
+    fmt.Println("MQTT message received!")
+
+    // Subscriptions are keyed by topic format
+    identifier, _ := GetIdentifier()
+    handler := subscriptions[strings.Replace(message.Topic(), identifier, "%s", 1)]
+
+    data, err := handler(client, message)
+
+    publishStatusResponse(client, message.Topic() + "/status", data, err)
 }
 
 var pingMsgRcvd = func(client mqtt.Client, message mqtt.Message) {
@@ -414,24 +1169,59 @@ var pingMsgRcvd = func(client mqtt.Client, message mqtt.Message) {
     }
 }
 
+// publishAutoRestore publishes the auto-restore policy retained, the status
+// topic only carries the plain state.
+func publishAutoRestore() {
+    settings := getSettings()
+
+    publishJSON(autoRestoreTopic, true, AutoRestoreStatus{
+        Policy: settings.AutoRestore,
+        Grace: settings.AutoRestoreGrace,
+    })
+}
+
+// autoRestoreBaseMap applies the auto-restore policy after the robot docked.
+func autoRestoreBaseMap() {
+    settings := getSettings()
+    controllerJob := autoRestoreJobKinds[Jobs.RecentKind(time.Duration(settings.AutoRestoreGrace) * time.Second)]
+
+    if settings.AutoRestore == autoRestoreNever ||
+            (settings.AutoRestore == autoRestoreControllerJobs && !controllerJob) {
+        fmt.Println("Keeping the live map, auto-restore policy is " + settings.AutoRestore + ".")
+        return
+    }
+
+    if err := restoreBaseMap(false); err != nil {
+        fmt.Printf("autoRestoreBaseMap: %s\n", err.Error())
+    }
+}
+
 func statusUpdateLoop(client mqtt.Client) {
     state := miio.VacStateUnknown
 
-    identifier, _ := GetIdentifier()
-    topic := fmt.Sprintf(statusUpdateTopic, identifier)
-
     for {
         Vacuum.UpdateStatus()
         updateMessage := Vacuum.GetUpdateMessage()
 
+        mapVersions.observe(updateMessage.State)
+        checkJobLimits(updateMessage.State)
+
         if state != updateMessage.State.State {
-            client.Publish(topic, 0, false, strconv.Itoa(int(state)))
+            publish(statusUpdateTopic, false, strconv.Itoa(int(updateMessage.State.State)))
 
             if state != miio.VacStateCharging && state != miio.VacStateFullyCharged &&
                     updateMessage.State.State == miio.VacStateCharging {
-                if err := restoreBaseMap(); err != nil {
-                    fmt.Printf("statusUpdateLoop: %s", err.Error())
+                // Before the restore overwrites what the clean has learned
+                mapVersions.docked()
+
+                if err := selectProfileByDock(); err != nil {
+                    fmt.Printf("statusUpdateLoop: %s\n", err.Error())
                 }
+
+                autoRestoreBaseMap()
+
+                // The live map may have been kept
+                publishMapGeometry()
             }
 
             state = updateMessage.State.State
@@ -505,6 +1295,7 @@ func main() {
     opts.SetPassword(mqttPassword)
 
     client := mqtt.NewClient(opts)
+    MqttClient = client
     if token := client.Connect(); token.Wait() && token.Error() != nil {
         panic(token.Error())
     }
@@ -521,7 +1312,41 @@ func main() {
         return
     }
 
+    copyMapMutex.Lock()
+    if err := recoverMapCopy(rockroboBasePath); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+    copyMapMutex.Unlock()
+
+    if err := loadSettings(); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+
+    if err := loadRecoveryStrategies(); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+
+    if err := loadProfiles(); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+
+    if err := selectProfileByDock(); err != nil {
+        fmt.Println("Profile: " + err.Error())
+    }
+    publishActiveProfile()
+    publishMapGeometry()
+    publishAutoRestore()
+
+    if err := loadSchedules(); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+
+    if err := loadBlackouts(); err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
+
     go statusUpdateLoop(client)
+    go schedulerLoop()
 
     <- signalChannel
 
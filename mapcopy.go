@@ -0,0 +1,268 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+)
+
+const (
+    mapCopyTmpSuffix = ".tmp"
+    mapCopyBackupSuffix = ".bak"
+)
+
+// Per file progress of a map copy
+const (
+    mapCopyStaged = "staged"
+    mapCopyVerified = "verified"
+    mapCopyInstalled = "installed"
+    mapCopyRolledBack = "rolled_back"
+)
+
+type MapCopyFile struct {
+    Name        string  `json:"name"`
+    Checksum    string  `json:"checksum"`
+    Status      string  `json:"status"`
+}
+
+// MapCopyReport describes what a map copy did to the destination.
+type MapCopyReport struct {
+    Source          string          `json:"source"`
+    Destination     string          `json:"destination"`
+    // False if the destination already held the same map
+    Changed         bool            `json:"changed"`
+    Files           []*MapCopyFile  `json:"files"`
+    RolledBack      bool            `json:"rolled_back"`
+    RollbackError   *string         `json:"rollback_error"`
+    Error           *string         `json:"error"`
+}
+
+func (report *MapCopyReport) fail(err error) error {
+    tmp := err.Error(); report.Error = &tmp
+
+    return err
+}
+
+func (report *MapCopyReport) String() string {
+    var status string
+
+    switch {
+    case report.Error == nil && !report.Changed:
+        status = "unchanged"
+    case report.Error == nil:
+        status = "copied"
+    case report.RollbackError != nil:
+        status = "failed, rollback failed: " + *report.RollbackError
+    case report.RolledBack:
+        status = "failed, previous map restored"
+    default:
+        status = "failed, destination untouched"
+    }
+
+    return fmt.Sprintf("%s -> %s: %s", report.Source, report.Destination, status)
+}
+
+// Writes source to path and syncs it to disk.
+func copyFileSynced(source string, path string) error {
+    srcFile, err := os.Open(source)
+    if err != nil {
+        return err
+    }
+    defer srcFile.Close()
+
+    destFile, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+
+    if _, err = io.Copy(destFile, srcFile); err != nil {
+        destFile.Close()
+        return err
+    }
+
+    if err = destFile.Sync(); err != nil {
+        destFile.Close()
+        return err
+    }
+
+    return destFile.Close()
+}
+
+func syncDirectory(directory string) error {
+    dir, err := os.Open(directory)
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+
+    return dir.Sync()
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+// recoverMapCopy cleans up after a copy that got interrupted by a crash.
+// Staged files left behind mean the new map was not installed completely, so
+// the backups are moved back. Otherwise only the backups are left over.
+// Must be called with copyMapMutex held.
+func recoverMapCopy(directory string) error {
+    incomplete := false
+    for _, file := range mapFiles {
+        if fileExists(directory + file + mapCopyTmpSuffix) {
+            incomplete = true
+        }
+    }
+
+    for _, file := range mapFiles {
+        path := directory + file
+
+        if incomplete && fileExists(path + mapCopyBackupSuffix) {
+            if err := os.Rename(path + mapCopyBackupSuffix, path); err != nil {
+                return err
+            }
+        }
+
+        os.Remove(path + mapCopyTmpSuffix)
+        os.Remove(path + mapCopyBackupSuffix)
+    }
+
+    return nil
+}
+
+// Moves the backups of all installed files back into place.
+func rollbackMapCopy(report *MapCopyReport, backedUp map[string]bool) {
+    var failed []string
+
+    for _, file := range report.Files {
+        path := report.Destination + file.Name
+
+        if file.Status == mapCopyInstalled {
+            if backedUp[file.Name] {
+                if err := os.Rename(path + mapCopyBackupSuffix, path); err != nil {
+                    failed = append(failed, err.Error())
+                    continue
+                }
+            } else {
+                os.Remove(path)
+            }
+
+            file.Status = mapCopyRolledBack
+        } else if backedUp[file.Name] {
+            if err := os.Rename(path + mapCopyBackupSuffix, path); err != nil {
+                failed = append(failed, err.Error())
+            }
+        }
+
+        os.Remove(path + mapCopyTmpSuffix)
+    }
+
+    report.RolledBack = true
+    if len(failed) > 0 {
+        tmp := fmt.Sprint(failed); report.RollbackError = &tmp
+    }
+
+    syncDirectory(report.Destination)
+}
+
+// copyMapFiles replaces the map in destination as a whole. The files are
+// staged next to their destination, verified and then renamed into place.
+// If anything fails the previous map is put back.
+// Must be called with copyMapMutex held.
+func copyMapFiles(source string, destination string) (*MapCopyReport, error) {
+    report := &MapCopyReport{
+        Source: source,
+        Destination: destination,
+        Files: []*MapCopyFile{},
+    }
+
+    if err := recoverMapCopy(destination); err != nil {
+        return report, report.fail(err)
+    }
+
+    for _, file := range mapFiles {
+        sourceHash, err := FileChecksum(source + file)
+        if err != nil {
+            return report, report.fail(err)
+        }
+
+        destinationHash, _ := FileChecksum(destination + file)
+        if sourceHash != destinationHash {
+            report.Changed = true
+        }
+
+        report.Files = append(report.Files, &MapCopyFile{
+            Name: file,
+            Checksum: sourceHash,
+        })
+    }
+
+    if !report.Changed {
+        return report, nil
+    }
+
+    if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+        return report, report.fail(err)
+    }
+
+    // Stage and verify
+    for _, file := range report.Files {
+        path := destination + file.Name + mapCopyTmpSuffix
+
+        if err := copyFileSynced(source + file.Name, path); err != nil {
+            recoverMapCopy(destination)
+            return report, report.fail(err)
+        }
+        file.Status = mapCopyStaged
+
+        checksum, err := FileChecksum(path)
+        if err == nil && checksum != file.Checksum {
+            err = errors.New("Checksum mismatch of staged " + file.Name + "!")
+        }
+
+        if err != nil {
+            recoverMapCopy(destination)
+            return report, report.fail(err)
+        }
+        file.Status = mapCopyVerified
+    }
+
+    // Keep the previous map until the new one is in place
+    backedUp := map[string]bool{}
+    for _, file := range report.Files {
+        path := destination + file.Name
+
+        if !fileExists(path) {
+            continue
+        }
+
+        if err := os.Rename(path, path + mapCopyBackupSuffix); err != nil {
+            rollbackMapCopy(report, backedUp)
+            return report, report.fail(err)
+        }
+        backedUp[file.Name] = true
+    }
+
+    for _, file := range report.Files {
+        path := destination + file.Name
+
+        if err := os.Rename(path + mapCopyTmpSuffix, path); err != nil {
+            rollbackMapCopy(report, backedUp)
+            return report, report.fail(err)
+        }
+        file.Status = mapCopyInstalled
+    }
+
+    if err := syncDirectory(destination); err != nil {
+        rollbackMapCopy(report, backedUp)
+        return report, report.fail(err)
+    }
+
+    for _, file := range report.Files {
+        os.Remove(destination + file.Name + mapCopyBackupSuffix)
+    }
+
+    return report, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "regexp"
+    "sort"
+    "time"
+)
+
+const mapMetadataFile = "metadata.json"
+
+// Files that make up a map
+var mapFiles = []string{"last_map", "ChargerPos.data", "StartPos.data"}
+
+// Snapshot names end up in a filesystem path
+var mapNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type MapFileInfo struct {
+    Size        int64   `json:"size"`
+    Checksum    string  `json:"checksum"`
+}
+
+type MapRobotState struct {
+    State       int     `json:"state"`
+    Battery     int     `json:"battery"`
+    Error       int     `json:"error"`
+    CleanArea   int     `json:"clean_area"`
+    CleanTime   int     `json:"clean_time"`
+}
+
+// MapMetadata is stored next to the files of every snapshot.
+type MapMetadata struct {
+    Name        string                  `json:"name"`
+    Created     time.Time               `json:"created"`
+    Files       map[string]MapFileInfo  `json:"files"`
+    Robot       *MapRobotState          `json:"robot,omitempty"`
+}
+
+type MapInspection struct {
+    MapMetadata
+    Base        bool        `json:"base"`
+    // Files whose size or checksum differ from the metadata
+    Modified    []string    `json:"modified"`
+}
+
+type MapRenameRequest struct {
+    From    string  `json:"from"`
+    To      string  `json:"to"`
+}
+
+func validateMapName(name string) error {
+    if !mapNameRegexp.MatchString(name) {
+        return errors.New("Invalid map name " + name + ", only letters, digits, - and _ are allowed!")
+    }
+
+    if name == profilesDirectory {
+        return errors.New("Map name " + name + " is reserved!")
+    }
+
+    return nil
+}
+
+// mapSnapshotPath returns the directory of a snapshot. The base map name
+// always refers to the base map of the active profile.
+func mapSnapshotPath(name string) string {
+    if name == baseMapName {
+        return baseMapPath()
+    }
+
+    return roomControllerBasePath + name + "/"
+}
+
+func isBaseMap(name string) bool {
+    return mapSnapshotPath(name) == baseMapPath()
+}
+
+func mapFileInfos(directory string) (map[string]MapFileInfo, error) {
+    infos := map[string]MapFileInfo{}
+
+    for _, file := range mapFiles {
+        stat, err := os.Stat(directory + file)
+        if err != nil {
+            return nil, err
+        }
+
+        checksum, err := FileChecksum(directory + file)
+        if err != nil {
+            return nil, err
+        }
+
+        infos[file] = MapFileInfo{
+            Size: stat.Size(),
+            Checksum: checksum,
+        }
+    }
+
+    return infos, nil
+}
+
+func writeMapMetadata(directory string, name string, robot *MapRobotState) (*MapMetadata, error) {
+    files, err := mapFileInfos(directory)
+    if err != nil {
+        return nil, err
+    }
+
+    metadata := &MapMetadata{
+        Name: name,
+        Created: time.Now(),
+        Files: files,
+        Robot: robot,
+    }
+
+    if err := WriteJSONFile(directory + mapMetadataFile, metadata); err != nil {
+        return nil, err
+    }
+
+    return metadata, nil
+}
+
+// readMapMetadata falls back to the files themselves for snapshots saved
+// before metadata existed.
+func readMapMetadata(name string) (*MapMetadata, error) {
+    var metadata MapMetadata
+
+    directory := mapSnapshotPath(name)
+
+    err := ReadJSONFile(directory + mapMetadataFile, &metadata)
+    if err == nil {
+        return &metadata, nil
+    }
+
+    if !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    stat, err := os.Stat(directory + mapFiles[0])
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, errors.New("Unknown map " + name + "!")
+        }
+
+        return nil, err
+    }
+
+    files, err := mapFileInfos(directory)
+    if err != nil {
+        return nil, err
+    }
+
+    return &MapMetadata{
+        Name: name,
+        Created: stat.ModTime(),
+        Files: files,
+    }, nil
+}
+
+func currentRobotState() *MapRobotState {
+    state := Vacuum.GetUpdateMessage().State
+
+    return &MapRobotState{
+        State: int(state.State),
+        Battery: state.Battery,
+        Error: int(state.Error),
+        CleanArea: state.CleanArea,
+        CleanTime: state.CleanTime,
+    }
+}
+
+// saveMapSnapshot copies the live map into the library.
+func saveMapSnapshot(name string) (*MapMetadata, error) {
+    if err := validateMapName(name); err != nil {
+        return nil, err
+    }
+
+    robot := currentRobotState()
+
+    if _, err := copyMapData(rockroboBasePath, mapSnapshotPath(name)); err != nil {
+        return nil, err
+    }
+
+    return writeMapMetadata(mapSnapshotPath(name), name, robot)
+}
+
+func listMapSnapshots() ([]MapMetadata, error) {
+    entries, err := ioutil.ReadDir(roomControllerBasePath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return []MapMetadata{}, nil
+        }
+
+        return nil, err
+    }
+
+    list := []MapMetadata{}
+
+    // Lives in the profile directory unless the default profile is active
+    if base, err := readMapMetadata(baseMapName); err == nil {
+        list = append(list, *base)
+    }
+
+    for _, entry := range entries {
+        if !entry.IsDir() || validateMapName(entry.Name()) != nil || entry.Name() == baseMapName {
+            continue
+        }
+
+        // Not every directory is a map
+        if _, err := os.Stat(mapSnapshotPath(entry.Name()) + mapFiles[0]); err != nil {
+            continue
+        }
+
+        metadata, err := readMapMetadata(entry.Name())
+        if err != nil {
+            return nil, err
+        }
+
+        list = append(list, *metadata)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Created.Before(list[j].Created)
+    })
+
+    return list, nil
+}
+
+func inspectMapSnapshot(name string) (*MapInspection, error) {
+    if err := validateMapName(name); err != nil {
+        return nil, err
+    }
+
+    metadata, err := readMapMetadata(name)
+    if err != nil {
+        return nil, err
+    }
+
+    inspection := &MapInspection{
+        MapMetadata: *metadata,
+        Base: isBaseMap(name),
+        Modified: []string{},
+    }
+
+    current, err := mapFileInfos(mapSnapshotPath(name))
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range mapFiles {
+        if current[file] != metadata.Files[file] {
+            inspection.Modified = append(inspection.Modified, file)
+        }
+    }
+
+    return inspection, nil
+}
+
+func renameMapSnapshot(from string, to string) error {
+    for _, name := range []string{from, to} {
+        if err := validateMapName(name); err != nil {
+            return err
+        }
+
+        if isBaseMap(name) {
+            return errors.New("The base map cannot be renamed, use set_base instead!")
+        }
+    }
+
+    metadata, err := readMapMetadata(from)
+    if err != nil {
+        return err
+    }
+
+    if _, err := os.Stat(mapSnapshotPath(to)); err == nil {
+        return errors.New("Map " + to + " already exists!")
+    }
+
+    copyMapMutex.Lock()
+    defer copyMapMutex.Unlock()
+
+    if err := os.Rename(mapSnapshotPath(from), mapSnapshotPath(to)); err != nil {
+        return err
+    }
+
+    metadata.Name = to
+
+    return WriteJSONFile(mapSnapshotPath(to) + mapMetadataFile, metadata)
+}
+
+func deleteMapSnapshot(name string) error {
+    if err := validateMapName(name); err != nil {
+        return err
+    }
+
+    if isBaseMap(name) {
+        return errors.New("The base map cannot be deleted!")
+    }
+
+    if _, err := readMapMetadata(name); err != nil {
+        return err
+    }
+
+    copyMapMutex.Lock()
+    defer copyMapMutex.Unlock()
+
+    return os.RemoveAll(mapSnapshotPath(name))
+}
+
+// setBaseMapSnapshot makes a snapshot the map restored before room cleans on
+// the active profile.
+func setBaseMapSnapshot(name string) error {
+    if err := validateMapName(name); err != nil {
+        return err
+    }
+
+    if isBaseMap(name) {
+        return nil
+    }
+
+    base := baseMapPath()
+
+    metadata, err := readMapMetadata(name)
+    if err != nil {
+        return err
+    }
+
+    copyMapMutex.Lock()
+    _, err = copyMapFiles(mapSnapshotPath(name), base)
+    copyMapMutex.Unlock()
+
+    if err != nil {
+        return err
+    }
+
+    _, err = writeMapMetadata(base, baseMapName, metadata.Robot)
+
+    return err
+}
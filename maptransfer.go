@@ -0,0 +1,455 @@
+package main
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strconv"
+)
+
+const (
+    mapTransferManifestFile = "manifest.json"
+
+    defaultMapChunkSize = 16 * 1024
+    maxMapChunkSize = 128 * 1024
+    // Missing chunks listed per file in import status messages
+    maxReportedMissingChunks = 100
+)
+
+// Staging area of incoming transfers, not a valid map name
+var mapImportPath = roomControllerBasePath + ".import/"
+
+type MapTransferFile struct {
+    Name        string  `json:"name"`
+    Size        int64   `json:"size"`
+    Checksum    string  `json:"checksum"`
+    Chunks      int     `json:"chunks"`
+}
+
+// MapTransferManifest announces a map transfer. Chunks are numbered per file
+// starting at 0.
+type MapTransferManifest struct {
+    Name        string              `json:"name"`
+    ChunkSize   int                 `json:"chunk_size"`
+    Files       []MapTransferFile   `json:"files"`
+    Metadata    *MapMetadata        `json:"metadata,omitempty"`
+    // Import only, replace an existing snapshot of the same name
+    Overwrite   bool                `json:"overwrite,omitempty"`
+}
+
+type MapTransferChunk struct {
+    Name    string  `json:"name"`
+    File    string  `json:"file"`
+    Seq     int     `json:"seq"`
+    Data    string  `json:"data"`
+}
+
+// MapExportRequest starts an export. Chunks lists the sequence numbers per
+// file to send again when resuming, all chunks are sent if it is empty.
+type MapExportRequest struct {
+    Name        string              `json:"name"`
+    ChunkSize   int                 `json:"chunk_size"`
+    Chunks      map[string][]int    `json:"chunks,omitempty"`
+}
+
+type MapImportStatus struct {
+    Name        string              `json:"name"`
+    Received    int                 `json:"received"`
+    Total       int                 `json:"total"`
+    Missing     map[string][]int    `json:"missing"`
+    Complete    bool                `json:"complete"`
+}
+
+func (manifest *MapTransferManifest) file(name string) (*MapTransferFile, error) {
+    for index := range manifest.Files {
+        if manifest.Files[index].Name == name {
+            return &manifest.Files[index], nil
+        }
+    }
+
+    return nil, errors.New("File " + name + " is not part of the transfer!")
+}
+
+func (manifest *MapTransferManifest) Validate() error {
+    if err := validateMapName(manifest.Name); err != nil {
+        return err
+    }
+
+    if manifest.ChunkSize < 1 || manifest.ChunkSize > maxMapChunkSize {
+        return fmt.Errorf("Chunk size %d is not between 1 and %d!", manifest.ChunkSize, maxMapChunkSize)
+    }
+
+    if len(manifest.Files) != len(mapFiles) {
+        return fmt.Errorf("Manifest lists %d files, expected %d!", len(manifest.Files), len(mapFiles))
+    }
+
+    for _, name := range mapFiles {
+        file, err := manifest.file(name)
+        if err != nil {
+            return err
+        }
+
+        expected := int((file.Size + int64(manifest.ChunkSize) - 1) / int64(manifest.ChunkSize))
+        if file.Size < 0 || file.Chunks != expected {
+            return fmt.Errorf("File %s: %d chunks do not match its size %d!", name, file.Chunks, file.Size)
+        }
+    }
+
+    return nil
+}
+
+func exportMapSnapshot(request MapExportRequest) (*MapTransferManifest, error) {
+    if err := validateMapName(request.Name); err != nil {
+        return nil, err
+    }
+
+    metadata, err := readMapMetadata(request.Name)
+    if err != nil {
+        return nil, err
+    }
+
+    chunkSize := request.ChunkSize
+    if chunkSize == 0 {
+        chunkSize = defaultMapChunkSize
+    }
+
+    manifest := &MapTransferManifest{
+        Name: request.Name,
+        ChunkSize: chunkSize,
+        Metadata: metadata,
+    }
+
+    directory := mapSnapshotPath(request.Name)
+    for _, name := range mapFiles {
+        stat, err := os.Stat(directory + name)
+        if err != nil {
+            return nil, err
+        }
+
+        checksum, err := FileChecksum(directory + name)
+        if err != nil {
+            return nil, err
+        }
+
+        manifest.Files = append(manifest.Files, MapTransferFile{
+            Name: name,
+            Size: stat.Size(),
+            Checksum: checksum,
+            Chunks: int((stat.Size() + int64(chunkSize) - 1) / int64(chunkSize)),
+        })
+    }
+
+    if err := manifest.Validate(); err != nil {
+        return nil, err
+    }
+
+    publishJSON(mapExportManifestTopic, false, manifest)
+
+    for _, file := range manifest.Files {
+        if err := exportMapFile(manifest, file, request.Chunks); err != nil {
+            return nil, err
+        }
+    }
+
+    return manifest, nil
+}
+
+func exportMapFile(manifest *MapTransferManifest, file MapTransferFile, resume map[string][]int) error {
+    sequences := resume[file.Name]
+    if len(resume) == 0 {
+        for seq := 0; seq < file.Chunks; seq++ {
+            sequences = append(sequences, seq)
+        }
+    }
+
+    f, err := os.Open(mapSnapshotPath(manifest.Name) + file.Name)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    buffer := make([]byte, manifest.ChunkSize)
+    for _, seq := range sequences {
+        if seq < 0 || seq >= file.Chunks {
+            return fmt.Errorf("File %s has no chunk %d!", file.Name, seq)
+        }
+
+        n, err := f.ReadAt(buffer, int64(seq) * int64(manifest.ChunkSize))
+        if err != nil && err != io.EOF {
+            return err
+        }
+
+        publishJSON(mapExportChunkTopic, false, MapTransferChunk{
+            Name: manifest.Name,
+            File: file.Name,
+            Seq: seq,
+            Data: base64.StdEncoding.EncodeToString(buffer[:n]),
+        })
+    }
+
+    return nil
+}
+
+func mapImportDirectory(name string) string {
+    return mapImportPath + name + "/"
+}
+
+func mapImportChunkPath(name string, file string, seq int) string {
+    return mapImportDirectory(name) + file + "." + strconv.Itoa(seq)
+}
+
+func readImportManifest(name string) (*MapTransferManifest, error) {
+    var manifest MapTransferManifest
+
+    if err := validateMapName(name); err != nil {
+        return nil, err
+    }
+
+    if err := ReadJSONFile(mapImportDirectory(name) + mapTransferManifestFile, &manifest); err != nil {
+        if os.IsNotExist(err) {
+            return nil, errors.New("No import of map " + name + " in progress!")
+        }
+
+        return nil, err
+    }
+
+    return &manifest, nil
+}
+
+// startMapImport begins or resumes an import. Chunks received for the same
+// manifest before are kept.
+func startMapImport(manifest MapTransferManifest) (*MapImportStatus, error) {
+    if err := manifest.Validate(); err != nil {
+        return nil, err
+    }
+
+    if isBaseMap(manifest.Name) {
+        return nil, errors.New("Imports cannot replace the base map, use set_base afterwards!")
+    }
+
+    if _, err := readMapMetadata(manifest.Name); err == nil && !manifest.Overwrite {
+        return nil, errors.New("Map " + manifest.Name + " already exists!")
+    }
+
+    previous, err := readImportManifest(manifest.Name)
+    if err == nil && !sameTransfer(previous, &manifest) {
+        // A different map under the same name, start over
+        if err := os.RemoveAll(mapImportDirectory(manifest.Name)); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := WriteJSONFile(mapImportDirectory(manifest.Name) + mapTransferManifestFile, manifest); err != nil {
+        return nil, err
+    }
+
+    return mapImportStatus(&manifest), nil
+}
+
+func sameTransfer(a *MapTransferManifest, b *MapTransferManifest) bool {
+    if a.ChunkSize != b.ChunkSize || len(a.Files) != len(b.Files) {
+        return false
+    }
+
+    for _, file := range a.Files {
+        other, err := b.file(file.Name)
+        if err != nil || *other != file {
+            return false
+        }
+    }
+
+    return true
+}
+
+func mapImportStatus(manifest *MapTransferManifest) *MapImportStatus {
+    status := &MapImportStatus{
+        Name: manifest.Name,
+        Missing: map[string][]int{},
+    }
+
+    for _, file := range manifest.Files {
+        status.Total += file.Chunks
+
+        missing := []int{}
+        for seq := 0; seq < file.Chunks; seq++ {
+            if fileExists(mapImportChunkPath(manifest.Name, file.Name, seq)) {
+                status.Received++
+            } else if len(missing) < maxReportedMissingChunks {
+                missing = append(missing, seq)
+            }
+        }
+
+        if len(missing) > 0 {
+            status.Missing[file.Name] = missing
+        }
+    }
+
+    return status
+}
+
+func getMapImportStatus(name string) (*MapImportStatus, error) {
+    manifest, err := readImportManifest(name)
+    if err != nil {
+        return nil, err
+    }
+
+    return mapImportStatus(manifest), nil
+}
+
+// receiveMapChunk stores a chunk and finishes the import once all chunks are
+// there.
+func receiveMapChunk(chunk MapTransferChunk) (*MapImportStatus, error) {
+    manifest, err := readImportManifest(chunk.Name)
+    if err != nil {
+        return nil, err
+    }
+
+    file, err := manifest.file(chunk.File)
+    if err != nil {
+        return nil, err
+    }
+
+    if chunk.Seq < 0 || chunk.Seq >= file.Chunks {
+        return nil, fmt.Errorf("File %s has no chunk %d!", chunk.File, chunk.Seq)
+    }
+
+    data, err := base64.StdEncoding.DecodeString(chunk.Data)
+    if err != nil {
+        return nil, err
+    }
+
+    expected := int64(manifest.ChunkSize)
+    if chunk.Seq == file.Chunks - 1 {
+        expected = file.Size - int64(chunk.Seq) * int64(manifest.ChunkSize)
+    }
+
+    if int64(len(data)) != expected {
+        return nil, fmt.Errorf("Chunk %d of %s has %d bytes, expected %d!", chunk.Seq, chunk.File, len(data), expected)
+    }
+
+    path := mapImportChunkPath(chunk.Name, chunk.File, chunk.Seq)
+    if err := ioutil.WriteFile(path + mapCopyTmpSuffix, data, 0644); err != nil {
+        return nil, err
+    }
+
+    if err := os.Rename(path + mapCopyTmpSuffix, path); err != nil {
+        return nil, err
+    }
+
+    status := mapImportStatus(manifest)
+    if status.Received < status.Total {
+        return status, nil
+    }
+
+    if err := finishMapImport(manifest); err != nil {
+        return nil, err
+    }
+
+    status.Complete = true
+
+    return status, nil
+}
+
+// Assembles and verifies the files, then adds them to the library.
+func finishMapImport(manifest *MapTransferManifest) error {
+    directory := mapImportDirectory(manifest.Name)
+    assembled := directory + "assembled/"
+
+    if err := os.MkdirAll(assembled, os.ModePerm); err != nil {
+        return err
+    }
+
+    for _, file := range manifest.Files {
+        if err := assembleMapFile(manifest, file, assembled + file.Name); err != nil {
+            return err
+        }
+
+        checksum, err := FileChecksum(assembled + file.Name)
+        if err != nil {
+            return err
+        }
+
+        if checksum != file.Checksum {
+            // Start this file over
+            for seq := 0; seq < file.Chunks; seq++ {
+                os.Remove(mapImportChunkPath(manifest.Name, file.Name, seq))
+            }
+
+            return errors.New("Checksum mismatch of imported " + file.Name + ", chunks discarded!")
+        }
+    }
+
+    copyMapMutex.Lock()
+    _, err := copyMapFiles(assembled, mapSnapshotPath(manifest.Name))
+    copyMapMutex.Unlock()
+
+    if err != nil {
+        return err
+    }
+
+    var robot *MapRobotState
+    if manifest.Metadata != nil {
+        robot = manifest.Metadata.Robot
+    }
+
+    if _, err := writeMapMetadata(mapSnapshotPath(manifest.Name), manifest.Name, robot); err != nil {
+        return err
+    }
+
+    return os.RemoveAll(directory)
+}
+
+func assembleMapFile(manifest *MapTransferManifest, file MapTransferFile, path string) error {
+    out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+
+    for seq := 0; seq < file.Chunks; seq++ {
+        data, err := ioutil.ReadFile(mapImportChunkPath(manifest.Name, file.Name, seq))
+        if err != nil {
+            out.Close()
+            return err
+        }
+
+        if _, err := out.Write(data); err != nil {
+            out.Close()
+            return err
+        }
+    }
+
+    if err := out.Sync(); err != nil {
+        out.Close()
+        return err
+    }
+
+    return out.Close()
+}
+
+func listMapImports() ([]MapImportStatus, error) {
+    entries, err := ioutil.ReadDir(mapImportPath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return []MapImportStatus{}, nil
+        }
+
+        return nil, err
+    }
+
+    list := []MapImportStatus{}
+    for _, entry := range entries {
+        if status, err := getMapImportStatus(entry.Name()); err == nil {
+            list = append(list, *status)
+        }
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "encoding/base64"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+)
+
+func useTempMapImportPath(t *testing.T) func() {
+    directory, err := ioutil.TempDir("", "maptransfer")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    previous := mapImportPath
+    mapImportPath = directory + "/"
+
+    return func() {
+        mapImportPath = previous
+        os.RemoveAll(directory)
+    }
+}
+
+// last_map has three chunks, ChargerPos.data two and StartPos.data none.
+func testTransferManifest() MapTransferManifest {
+    return MapTransferManifest{
+        Name: "upstairs",
+        ChunkSize: 4,
+        Files: []MapTransferFile{
+            {Name: "last_map", Size: 10, Checksum: "a", Chunks: 3},
+            {Name: "ChargerPos.data", Size: 5, Checksum: "b", Chunks: 2},
+            {Name: "StartPos.data", Size: 0, Checksum: "c", Chunks: 0},
+        },
+    }
+}
+
+func testTransferChunk(file string, seq int, data string) MapTransferChunk {
+    return MapTransferChunk{
+        Name: "upstairs",
+        File: file,
+        Seq: seq,
+        Data: base64.StdEncoding.EncodeToString([]byte(data)),
+    }
+}
+
+func TestMapTransferManifestValidate(t *testing.T) {
+    manifest := testTransferManifest()
+    if err := manifest.Validate(); err != nil {
+        t.Fatal(err)
+    }
+
+    invalid := []func(manifest *MapTransferManifest){
+        func(manifest *MapTransferManifest) { manifest.Name = "../upstairs" },
+        func(manifest *MapTransferManifest) { manifest.ChunkSize = 0 },
+        func(manifest *MapTransferManifest) { manifest.ChunkSize = maxMapChunkSize + 1 },
+        func(manifest *MapTransferManifest) { manifest.Files = manifest.Files[:2] },
+        func(manifest *MapTransferManifest) { manifest.Files[2].Name = "other" },
+        func(manifest *MapTransferManifest) { manifest.Files[0].Chunks = 2 },
+        func(manifest *MapTransferManifest) { manifest.Files[2].Size = -1 },
+    }
+
+    for index, modify := range invalid {
+        manifest := testTransferManifest()
+        manifest.Files = append([]MapTransferFile{}, manifest.Files...)
+        modify(&manifest)
+
+        if err := manifest.Validate(); err == nil {
+            t.Errorf("Manifest %d accepted: %+v", index, manifest)
+        }
+    }
+}
+
+func TestMapImportResume(t *testing.T) {
+    defer useTempMapImportPath(t)()
+
+    manifest := testTransferManifest()
+
+    status, err := startMapImport(manifest)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := map[string][]int{"last_map": {0, 1, 2}, "ChargerPos.data": {0, 1}}
+    if status.Total != 5 || status.Received != 0 || !reflect.DeepEqual(status.Missing, expected) {
+        t.Fatalf("Status %+v", status)
+    }
+
+    for _, chunk := range []MapTransferChunk{
+        testTransferChunk("last_map", 2, "ij"),
+        testTransferChunk("last_map", 0, "abcd"),
+        testTransferChunk("ChargerPos.data", 1, "e"),
+        // Sent twice
+        testTransferChunk("last_map", 0, "abcd"),
+    } {
+        if status, err = receiveMapChunk(chunk); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    expected = map[string][]int{"last_map": {1}, "ChargerPos.data": {0}}
+    if status.Received != 3 || status.Complete || !reflect.DeepEqual(status.Missing, expected) {
+        t.Fatalf("Status %+v", status)
+    }
+
+    // Announcing the same transfer again keeps the chunks
+    if status, err = startMapImport(manifest); err != nil {
+        t.Fatal(err)
+    }
+
+    if status.Received != 3 || !reflect.DeepEqual(status.Missing, expected) {
+        t.Fatalf("Resumed status %+v", status)
+    }
+
+    list, err := listMapImports()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(list) != 1 || list[0].Name != "upstairs" || list[0].Received != 3 {
+        t.Fatalf("Imports %+v", list)
+    }
+
+    // A different map under the same name starts over
+    manifest.Files = append([]MapTransferFile{}, manifest.Files...)
+    manifest.Files[0].Checksum = "d"
+    if status, err = startMapImport(manifest); err != nil {
+        t.Fatal(err)
+    }
+
+    if status.Received != 0 {
+        t.Fatalf("Restarted status %+v", status)
+    }
+}
+
+func TestMapImportRejectsChunks(t *testing.T) {
+    defer useTempMapImportPath(t)()
+
+    if _, err := receiveMapChunk(testTransferChunk("last_map", 0, "abcd")); err == nil {
+        t.Fatal("Chunk without import accepted")
+    }
+
+    if _, err := startMapImport(testTransferManifest()); err != nil {
+        t.Fatal(err)
+    }
+
+    invalid := []MapTransferChunk{
+        testTransferChunk("other", 0, "abcd"),
+        testTransferChunk("last_map", -1, "abcd"),
+        testTransferChunk("last_map", 3, "abcd"),
+        // Short chunk in the middle of the file
+        testTransferChunk("last_map", 0, "abc"),
+        // Last chunk has to match the remaining size
+        testTransferChunk("last_map", 2, "ijkl"),
+        testTransferChunk("ChargerPos.data", 1, ""),
+        {Name: "upstairs", File: "last_map", Seq: 0, Data: "not base64"},
+    }
+
+    for _, chunk := range invalid {
+        if _, err := receiveMapChunk(chunk); err == nil {
+            t.Errorf("Chunk %+v accepted", chunk)
+        }
+    }
+
+    status, err := getMapImportStatus("upstairs")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if status.Received != 0 {
+        t.Fatalf("Status %+v", status)
+    }
+}
+
+func TestMapImportStatusLimitsMissing(t *testing.T) {
+    defer useTempMapImportPath(t)()
+
+    manifest := testTransferManifest()
+    manifest.ChunkSize = 1
+    manifest.Files = []MapTransferFile{
+        {Name: "last_map", Size: 150, Checksum: "a", Chunks: 150},
+        {Name: "ChargerPos.data", Size: 5, Checksum: "b", Chunks: 5},
+        {Name: "StartPos.data", Size: 0, Checksum: "c", Chunks: 0},
+    }
+
+    status, err := startMapImport(manifest)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if status.Total != 155 || len(status.Missing["last_map"]) != maxReportedMissingChunks {
+        t.Fatalf("Total %d, %d chunks of last_map reported", status.Total, len(status.Missing["last_map"]))
+    }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const (
+    autoMapPrefix = "auto-"
+    // Number of automatic snapshots kept
+    autoMapVersionsKeep = 5
+)
+
+type MapEvent struct {
+    Event   string      `json:"event"`
+    Map     string      `json:"map"`
+    Time    time.Time   `json:"time"`
+}
+
+// mapVersioner follows full cleans started with app_start and takes a
+// snapshot once one of them ends on the dock on its own and without errors.
+type mapVersioner struct {
+    sync.Mutex
+
+    cleaning    bool
+    errored     bool
+    paused      bool
+    // Why the clean got cut short, empty if it was not
+    interrupted string
+}
+
+var mapVersions = &mapVersioner{}
+
+// observe must be called with every status update.
+func (v *mapVersioner) observe(state *miio.VacuumState) {
+    v.Lock()
+    defer v.Unlock()
+
+    switch state.State {
+    case miio.VacStateCleaning:
+        if !v.cleaning {
+            v.cleaning = true
+            v.errored = false
+            v.interrupted = ""
+        }
+
+        v.paused = false
+    case miio.VacStatePaused:
+        v.paused = true
+    case miio.VacStateReturning, miio.VacStateDocking, miio.VacStateCharging:
+        if v.cleaning && v.paused && v.interrupted == "" {
+            v.interrupted = "docked while paused"
+        }
+    case miio.VacStateInError, miio.VacStateChargingError:
+        v.errored = true
+    case miio.VacStateZoneClean, miio.VacStateSpot, miio.VacStateGoTo, miio.VacStateRoomClean:
+        // Partial cleans do not see the whole map
+        v.cleaning = false
+    }
+
+    if state.Error != miio.VacErrorNo {
+        v.errored = true
+    }
+}
+
+// interrupt must be called whenever the controller sends the robot home, a
+// full clean running at that time did not see the whole map.
+func (v *mapVersioner) interrupt(reason string) {
+    v.Lock()
+    defer v.Unlock()
+
+    if v.cleaning && v.interrupted == "" {
+        v.interrupted = reason
+    }
+}
+
+// finish ends the tracked full clean. It reports whether one was running
+// and why it does not qualify for a map version, if it does not.
+func (v *mapVersioner) finish() (bool, string) {
+    v.Lock()
+    defer v.Unlock()
+
+    cleaning := v.cleaning
+    v.cleaning = false
+    v.paused = false
+
+    switch {
+    case !cleaning:
+        return false, ""
+    case v.errored:
+        return true, "ended with errors"
+    case v.interrupted != "":
+        return true, "cut short: " + v.interrupted
+    }
+
+    return true, ""
+}
+
+// docked must be called on the transition into VacStateCharging, before the
+// base map gets restored.
+func (v *mapVersioner) docked() {
+    cleaning, reason := v.finish()
+    if !cleaning {
+        return
+    }
+
+    if reason != "" {
+        fmt.Println("Full clean " + reason + ", no map version taken.")
+        return
+    }
+
+    name := autoMapPrefix + time.Now().Format("20060102-150405")
+    if _, err := saveMapSnapshot(name); err != nil {
+        fmt.Printf("mapVersioner: %s\n", err.Error())
+        return
+    }
+
+    fmt.Printf("Saved map version %s.\n", name)
+
+    if err := pruneMapVersions(); err != nil {
+        fmt.Printf("mapVersioner: %s\n", err.Error())
+    }
+
+    // Promoting the version to the base map stays a manual decision
+    publishJSON(mapEventsTopic, false, MapEvent{
+        Event: "base_promotable",
+        Map: name,
+        Time: time.Now(),
+    })
+}
+
+func pruneMapVersions() error {
+    snapshots, err := listMapSnapshots()
+    if err != nil {
+        return err
+    }
+
+    // Sorted oldest first
+    var versions []string
+    for _, snapshot := range snapshots {
+        if strings.HasPrefix(snapshot.Name, autoMapPrefix) {
+            versions = append(versions, snapshot.Name)
+        }
+    }
+
+    for len(versions) > autoMapVersionsKeep {
+        if err := deleteMapSnapshot(versions[0]); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+
+        versions = versions[1:]
+    }
+
+    return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+func TestMapVersionerFinish(t *testing.T) {
+    tests := []struct {
+        name        string
+        states      []miio.VacState
+        interrupt   string
+        cleaning    bool
+        eligible    bool
+    }{
+        {"finished", []miio.VacState{miio.VacStateCleaning, miio.VacStateReturning, miio.VacStateCharging}, "", true, true},
+        {"resumed", []miio.VacState{miio.VacStateCleaning, miio.VacStatePaused, miio.VacStateCleaning, miio.VacStateReturning}, "", true, true},
+        {"docked while paused", []miio.VacState{miio.VacStateCleaning, miio.VacStatePaused, miio.VacStateReturning}, "", true, false},
+        {"stopped by the controller", []miio.VacState{miio.VacStateCleaning}, "max_minutes", true, false},
+        {"error", []miio.VacState{miio.VacStateCleaning, miio.VacStateInError, miio.VacStateReturning}, "", true, false},
+        {"zoned clean", []miio.VacState{miio.VacStateZoneClean, miio.VacStateReturning}, "dock command", false, false},
+        {"partial after full", []miio.VacState{miio.VacStateCleaning, miio.VacStateGoTo, miio.VacStateReturning}, "", false, false},
+    }
+
+    for _, test := range tests {
+        v := &mapVersioner{}
+
+        for _, state := range test.states {
+            v.observe(&miio.VacuumState{State: state})
+        }
+
+        if test.interrupt != "" {
+            v.interrupt(test.interrupt)
+        }
+
+        cleaning, reason := v.finish()
+        if cleaning != test.cleaning || (cleaning && (reason == "") != test.eligible) {
+            t.Errorf("%s: cleaning %t, reason %q", test.name, cleaning, reason)
+        }
+
+        // The next full clean starts over
+        v.observe(&miio.VacuumState{State: miio.VacStateCleaning})
+        if cleaning, reason := v.finish(); !cleaning || reason != "" {
+            t.Errorf("%s: next clean %t, reason %q", test.name, cleaning, reason)
+        }
+    }
+}
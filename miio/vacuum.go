@@ -34,6 +34,7 @@ const (
     cmdStart        = "app_start"
     cmdGotoTarget   = "app_goto_target"
     cmdZonedClean   = "app_zoned_clean"
+    cmdSpot         = "app_spot"
     cmdStop         = "app_stop"
     cmdPause        = "app_pause"
     cmdDock         = "app_charge"
@@ -115,8 +116,11 @@ type VacuumState struct {
     IsDND      bool
     IsCleaning bool
     FanPower   int
+    MapPresent bool
     Error      VacError
     State      VacState
+    // When the last status got parsed
+    Updated    time.Time
 }
 
 // Vacuum state obtained from the device.
@@ -186,6 +190,14 @@ func (v *Vacuum) GetUpdateMessage() *DeviceUpdateMessage {
     }
 }
 
+// Snapshot returns a copy of the state that later updates leave alone.
+func (v *Vacuum) Snapshot() VacuumState {
+    v.Lock()
+    defer v.Unlock()
+
+    return *v.State
+}
+
 // UpdateState performs a state update.
 func (v *Vacuum) UpdateState() {
     v.Lock()
@@ -213,6 +225,8 @@ func (v *Vacuum) UpdateState() {
     v.State.IsDND = r.Result[0].DNDEnabled != 0
     v.State.IsCleaning = r.Result[0].Cleaning != 0
     v.State.FanPower = r.Result[0].FanPower
+    v.State.MapPresent = r.Result[0].MapPresent != 0
+    v.State.Updated = time.Now()
 
     switch r.Result[0].ErrorCode {
     case 0:
@@ -315,6 +329,16 @@ func (v *Vacuum) ZonedClean(zones [][]int) bool {
     return v.UpdateStatus()
 }
 
+// SpotClean cleans the area around the robot.
+func (v *Vacuum) SpotClean() bool {
+    if !v.sendCommand(cmdSpot, nil, false, vacRetries) {
+        return false
+    }
+
+    time.Sleep(1 * time.Second)
+    return v.UpdateStatus()
+}
+
 // PauseCleaning pauses the cleaning cycle.
 func (v *Vacuum) PauseCleaning() bool {
     if !v.sendCommand(cmdPause, nil, false, vacRetries) {
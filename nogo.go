@@ -0,0 +1,193 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+)
+
+// Remainders narrower than this are dropped, the robot does not fit (mm)
+const noGoMinZoneSize = 100
+
+// NoGoArea is a set of rectangles the controller keeps the robot out of:
+// [x1, y1, x2, y2]
+type NoGoArea struct {
+    Name    string      `json:"name"`
+    Zones   [][4]int    `json:"zones"`
+}
+
+var noGoMutex sync.Mutex
+var noGoAreas = map[string]NoGoArea{}
+// No-go areas of the active profile
+var noGoPath string
+
+func (area NoGoArea) Validate() error {
+    if area.Name == "" {
+        return errors.New("No-go area without name!")
+    }
+
+    if len(area.Zones) == 0 {
+        return errors.New("No-go area " + area.Name + " has no zones!")
+    }
+
+    for index, zone := range area.Zones {
+        if zone[0] >= zone[2] || zone[1] >= zone[3] {
+            return fmt.Errorf("Zone %d of no-go area %s is not [x1,y1,x2,y2] with x1 < x2 and y1 < y2!", index, area.Name)
+        }
+
+        for _, value := range zone {
+            if value < mapMinCoordinate || value > mapMaxCoordinate {
+                return fmt.Errorf("Zone %d of no-go area %s is outside of the map!", index, area.Name)
+            }
+        }
+    }
+
+    return nil
+}
+
+func loadNoGoAreas(path string) error {
+    stored := map[string]NoGoArea{}
+
+    if err := ReadJSONFile(path, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    noGoMutex.Lock()
+    noGoAreas = stored
+    noGoPath = path
+    noGoMutex.Unlock()
+
+    return nil
+}
+
+func listNoGoAreas() []NoGoArea {
+    noGoMutex.Lock()
+    defer noGoMutex.Unlock()
+
+    list := make([]NoGoArea, 0, len(noGoAreas))
+    for _, area := range noGoAreas {
+        list = append(list, area)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+func setNoGoArea(area NoGoArea) error {
+    if err := area.Validate(); err != nil {
+        return err
+    }
+
+    noGoMutex.Lock()
+    defer noGoMutex.Unlock()
+
+    previous, existed := noGoAreas[area.Name]
+    noGoAreas[area.Name] = area
+
+    if err := WriteJSONFile(noGoPath, noGoAreas); err != nil {
+        if existed {
+            noGoAreas[area.Name] = previous
+        } else {
+            delete(noGoAreas, area.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteNoGoArea(name string) error {
+    noGoMutex.Lock()
+    defer noGoMutex.Unlock()
+
+    area, ok := noGoAreas[name]
+    if !ok {
+        return errors.New("Unknown no-go area " + name + "!")
+    }
+
+    delete(noGoAreas, name)
+    if err := WriteJSONFile(noGoPath, noGoAreas); err != nil {
+        noGoAreas[name] = area
+        return err
+    }
+
+    return nil
+}
+
+func noGoRects() [][4]int {
+    noGoMutex.Lock()
+    defer noGoMutex.Unlock()
+
+    var rects [][4]int
+    for _, area := range noGoAreas {
+        rects = append(rects, area.Zones...)
+    }
+
+    return rects
+}
+
+// checkNoGo fails if the point lies within a no-go area.
+func checkNoGo(x int, y int) error {
+    noGoMutex.Lock()
+    defer noGoMutex.Unlock()
+
+    for _, area := range noGoAreas {
+        for _, zone := range area.Zones {
+            if x >= zone[0] && x <= zone[2] && y >= zone[1] && y <= zone[3] {
+                return fmt.Errorf("%d, %d is within no-go area %s!", x, y, area.Name)
+            }
+        }
+    }
+
+    return nil
+}
+
+// subtractRect splits zone into the parts not covered by rect.
+func subtractRect(zone Zone, rect [4]int) []Zone {
+    if rect[0] >= zone.X2 || rect[2] <= zone.X1 || rect[1] >= zone.Y2 || rect[3] <= zone.Y1 {
+        return []Zone{zone}
+    }
+
+    x1 := maxInt(zone.X1, rect[0])
+    x2 := minInt(zone.X2, rect[2])
+
+    pieces := []Zone{
+        // Left and right over the full height
+        {zone.X1, zone.Y1, rect[0], zone.Y2, zone.Repeats},
+        {rect[2], zone.Y1, zone.X2, zone.Y2, zone.Repeats},
+        // Below and above between them
+        {x1, zone.Y1, x2, rect[1], zone.Repeats},
+        {x1, rect[3], x2, zone.Y2, zone.Repeats},
+    }
+
+    var remainder []Zone
+    for _, piece := range pieces {
+        if piece.X2 - piece.X1 >= noGoMinZoneSize && piece.Y2 - piece.Y1 >= noGoMinZoneSize {
+            remainder = append(remainder, piece)
+        }
+    }
+
+    return remainder
+}
+
+// applyNoGoAreas removes the no-go areas from the zones.
+func applyNoGoAreas(zones RoomZones) RoomZones {
+    result := append(RoomZones{}, zones...)
+
+    for _, rect := range noGoRects() {
+        var next RoomZones
+        for _, zone := range result {
+            next = append(next, subtractRect(zone, rect)...)
+        }
+
+        result = next
+    }
+
+    return result
+}
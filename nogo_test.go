@@ -0,0 +1,169 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+)
+
+// Replaces the no-go areas of the active profile for a test.
+func useTestNoGoAreas(t *testing.T, areas ...NoGoArea) func() {
+    directory, err := ioutil.TempDir("", "nogo")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    previousAreas, previousPath := noGoAreas, noGoPath
+
+    noGoAreas = map[string]NoGoArea{}
+    for _, area := range areas {
+        noGoAreas[area.Name] = area
+    }
+    noGoPath = directory + "/nogo.json"
+
+    return func() {
+        noGoAreas, noGoPath = previousAreas, previousPath
+        os.RemoveAll(directory)
+    }
+}
+
+func TestSubtractRect(t *testing.T) {
+    zone := Zone{1000, 1000, 2000, 2000, 2}
+
+    tests := []struct {
+        name        string
+        rect        [4]int
+        expected    []Zone
+    }{
+        {"apart", [4]int{3000, 3000, 4000, 4000}, []Zone{zone}},
+        {"touching", [4]int{2000, 1000, 3000, 2000}, []Zone{zone}},
+        {"covered", [4]int{0, 0, 3000, 3000}, nil},
+        {
+            "center",
+            [4]int{1400, 1400, 1600, 1600},
+            []Zone{
+                {1000, 1000, 1400, 2000, 2},
+                {1600, 1000, 2000, 2000, 2},
+                {1400, 1000, 1600, 1400, 2},
+                {1400, 1600, 1600, 2000, 2},
+            },
+        },
+        {
+            "corner",
+            [4]int{1500, 1500, 2500, 2500},
+            []Zone{
+                {1000, 1000, 1500, 2000, 2},
+                {1500, 1000, 2000, 1500, 2},
+            },
+        },
+        {
+            "stripe",
+            [4]int{0, 1300, 3000, 1700},
+            []Zone{
+                {1000, 1000, 2000, 1300, 2},
+                {1000, 1700, 2000, 2000, 2},
+            },
+        },
+        {
+            // Slivers narrower than noGoMinZoneSize are dropped
+            "slivers",
+            [4]int{1050, 1000 + noGoMinZoneSize - 1, 1500, 2000 - noGoMinZoneSize},
+            []Zone{
+                {1500, 1000, 2000, 2000, 2},
+                {1050, 2000 - noGoMinZoneSize, 1500, 2000, 2},
+            },
+        },
+    }
+
+    for _, test := range tests {
+        if remainder := subtractRect(zone, test.rect); !reflect.DeepEqual(remainder, test.expected) {
+            t.Errorf("%s: remainder %v, expected %v", test.name, remainder, test.expected)
+        }
+    }
+}
+
+func TestApplyNoGoAreas(t *testing.T) {
+    defer useTestNoGoAreas(t, NoGoArea{Name: "kitchen", Zones: [][4]int{
+        {1400, 0, 1600, 3000},
+        {0, 1900, 1200, 3000},
+    }})()
+
+    zones := RoomZones{{1000, 1000, 2000, 2000, 1}, {5000, 5000, 6000, 6000, 3}}
+    result := applyNoGoAreas(zones)
+
+    expected := RoomZones{
+        {1200, 1000, 1400, 2000, 1},
+        {1000, 1000, 1200, 1900, 1},
+        {1600, 1000, 2000, 2000, 1},
+        {5000, 5000, 6000, 6000, 3},
+    }
+
+    if !reflect.DeepEqual(result, expected) {
+        t.Errorf("Zones %v, expected %v", result, expected)
+    }
+
+    if zones[0] != (Zone{1000, 1000, 2000, 2000, 1}) {
+        t.Errorf("Input zones modified: %v", zones)
+    }
+}
+
+func TestCheckNoGo(t *testing.T) {
+    defer useTestNoGoAreas(t, NoGoArea{Name: "rug", Zones: [][4]int{{1000, 1000, 2000, 2000}}})()
+
+    for _, point := range [][2]int{{1000, 1000}, {1500, 1500}, {2000, 2000}} {
+        if checkNoGo(point[0], point[1]) == nil {
+            t.Errorf("%v is not in the no-go area", point)
+        }
+    }
+
+    for _, point := range [][2]int{{999, 1500}, {1500, 2001}} {
+        if err := checkNoGo(point[0], point[1]); err != nil {
+            t.Error(err)
+        }
+    }
+}
+
+func TestNoGoAreaValidate(t *testing.T) {
+    invalid := []NoGoArea{
+        {Zones: [][4]int{{0, 0, 100, 100}}},
+        {Name: "rug"},
+        {Name: "rug", Zones: [][4]int{{100, 0, 100, 100}}},
+        {Name: "rug", Zones: [][4]int{{0, 100, 100, 0}}},
+        {Name: "rug", Zones: [][4]int{{0, 0, 100, mapMaxCoordinate + 1}}},
+    }
+
+    for _, area := range invalid {
+        if area.Validate() == nil {
+            t.Errorf("No-go area %+v accepted", area)
+        }
+    }
+}
+
+func TestSetNoGoAreaRollback(t *testing.T) {
+    rug := NoGoArea{Name: "rug", Zones: [][4]int{{0, 0, 100, 100}}}
+    defer useTestNoGoAreas(t, rug)()
+
+    if err := setNoGoArea(NoGoArea{Name: "bowl", Zones: [][4]int{{200, 200, 300, 300}}}); err != nil {
+        t.Fatal(err)
+    }
+
+    // The file is in the way of the directory
+    noGoPath += "/nogo.json"
+
+    if setNoGoArea(NoGoArea{Name: "rug", Zones: [][4]int{{0, 0, 500, 500}}}) == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if setNoGoArea(NoGoArea{Name: "sofa", Zones: [][4]int{{0, 0, 500, 500}}}) == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if deleteNoGoArea("bowl") == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if list := listNoGoAreas(); len(list) != 2 || !reflect.DeepEqual(list[1], rug) {
+        t.Fatalf("No-go areas %+v after failed writes", list)
+    }
+}
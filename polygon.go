@@ -0,0 +1,490 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "unicode"
+
+    "github.com/novag/gen1_room_controller/coords"
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+// Polygons are rasterized to map pixels before being decomposed
+const polygonCellSize = rrmap.Resolution
+
+type polygonPoint struct {
+    X   float64
+    Y   float64
+}
+
+// Rings are filled with the even-odd rule, inner rings are holes.
+type polygon [][]polygonPoint
+
+// RoomImportRequest is the payload of rooms/import. The outline is either an
+// SVG path or a GeoJSON polygon, the coordinates field applies to it and to
+// the idle point.
+type RoomImportRequest struct {
+    Room
+    SVG         string          `json:"svg,omitempty"`
+    GeoJSON     json.RawMessage `json:"geojson,omitempty"`
+    Repeat      int             `json:"repeat,omitempty"`
+}
+
+type RoomImportResult struct {
+    Room        Room        `json:"room"`
+    // Share of the outline not covered by the zones
+    Uncovered   float64     `json:"uncovered"`
+    // Uncovered area in m²
+    UncoveredArea float64   `json:"uncovered_area"`
+    Warning     *string     `json:"warning"`
+}
+
+// parseSVGPath reads the straight line commands of an SVG path.
+func parseSVGPath(d string) (polygon, error) {
+    var rings polygon
+    var ring []polygonPoint
+    var current, start polygonPoint
+    var command rune
+
+    tokens := tokenizeSVGPath(d)
+    number := func() (float64, error) {
+        if len(tokens) == 0 {
+            return 0, errors.New("Unexpected end of path!")
+        }
+
+        value, err := strconv.ParseFloat(tokens[0], 64)
+        if err != nil {
+            return 0, errors.New("Invalid number " + tokens[0] + " in path!")
+        }
+
+        tokens = tokens[1:]
+        return value, nil
+    }
+
+    closeRing := func() {
+        if len(ring) > 2 {
+            rings = append(rings, ring)
+        }
+        ring = nil
+    }
+
+    for len(tokens) > 0 {
+        if r := rune(tokens[0][0]); unicode.IsLetter(r) {
+            command = r
+            tokens = tokens[1:]
+        } else if command == 0 {
+            return nil, errors.New("Path does not start with a command!")
+        }
+
+        relative := unicode.IsLower(command)
+        next := current
+        moved := false
+
+        switch unicode.ToUpper(command) {
+        case 'M', 'L':
+            x, err := number()
+            if err != nil {
+                return nil, err
+            }
+
+            y, err := number()
+            if err != nil {
+                return nil, err
+            }
+
+            if relative {
+                x += current.X
+                y += current.Y
+            }
+
+            next = polygonPoint{x, y}
+            if unicode.ToUpper(command) == 'M' {
+                closeRing()
+                start = next
+                moved = true
+
+                // Further pairs are line segments
+                if relative {
+                    command = 'l'
+                } else {
+                    command = 'L'
+                }
+            }
+        case 'H':
+            x, err := number()
+            if err != nil {
+                return nil, err
+            }
+
+            if relative {
+                x += current.X
+            }
+
+            next.X = x
+        case 'V':
+            y, err := number()
+            if err != nil {
+                return nil, err
+            }
+
+            if relative {
+                y += current.Y
+            }
+
+            next.Y = y
+        case 'Z':
+            closeRing()
+            current = start
+            continue
+        default:
+            return nil, fmt.Errorf("Unsupported path command %c, only straight lines are supported!", command)
+        }
+
+        // Lines drawn right after Z start at the closed subpath's start
+        if len(ring) == 0 && !moved {
+            ring = append(ring, current)
+        }
+
+        ring = append(ring, next)
+        current = next
+    }
+
+    closeRing()
+
+    if len(rings) == 0 {
+        return nil, errors.New("Path has no area!")
+    }
+
+    return rings, nil
+}
+
+func tokenizeSVGPath(d string) []string {
+    var tokens []string
+    var token strings.Builder
+
+    flush := func() {
+        if token.Len() > 0 {
+            tokens = append(tokens, token.String())
+            token.Reset()
+        }
+    }
+
+    for _, r := range d {
+        switch {
+        case unicode.IsLetter(r) && r != 'e' && r != 'E':
+            flush()
+            tokens = append(tokens, string(r))
+        case r == '-' && token.Len() > 0 && !strings.HasSuffix(strings.ToLower(token.String()), "e"):
+            flush()
+            token.WriteRune(r)
+        case unicode.IsSpace(r) || r == ',':
+            flush()
+        default:
+            token.WriteRune(r)
+        }
+    }
+
+    flush()
+
+    return tokens
+}
+
+// parseGeoJSON reads a Polygon or MultiPolygon, bare or wrapped in a Feature
+// or FeatureCollection.
+func parseGeoJSON(data []byte) (polygon, error) {
+    var object struct {
+        Type        string              `json:"type"`
+        Geometry    json.RawMessage     `json:"geometry"`
+        Features    []json.RawMessage   `json:"features"`
+        Coordinates json.RawMessage     `json:"coordinates"`
+    }
+
+    if err := json.Unmarshal(data, &object); err != nil {
+        return nil, err
+    }
+
+    var rings polygon
+
+    switch object.Type {
+    case "Feature":
+        return parseGeoJSON(object.Geometry)
+    case "FeatureCollection":
+        if len(object.Features) != 1 {
+            return nil, errors.New("Feature collection must hold exactly one feature!")
+        }
+
+        return parseGeoJSON(object.Features[0])
+    case "Polygon":
+        var coordinates [][][]float64
+        if err := json.Unmarshal(object.Coordinates, &coordinates); err != nil {
+            return nil, err
+        }
+
+        rings = appendGeoJSONRings(rings, coordinates)
+    case "MultiPolygon":
+        var coordinates [][][][]float64
+        if err := json.Unmarshal(object.Coordinates, &coordinates); err != nil {
+            return nil, err
+        }
+
+        for _, polygon := range coordinates {
+            rings = appendGeoJSONRings(rings, polygon)
+        }
+    default:
+        return nil, errors.New("Unsupported GeoJSON type " + object.Type + "!")
+    }
+
+    if len(rings) == 0 {
+        return nil, errors.New("Polygon has no area!")
+    }
+
+    return rings, nil
+}
+
+func appendGeoJSONRings(rings polygon, coordinates [][][]float64) polygon {
+    for _, coordinateRing := range coordinates {
+        var ring []polygonPoint
+        for _, position := range coordinateRing {
+            if len(position) >= 2 {
+                ring = append(ring, polygonPoint{position[0], position[1]})
+            }
+        }
+
+        if len(ring) > 2 {
+            rings = append(rings, ring)
+        }
+    }
+
+    return rings
+}
+
+// toRobot converts all vertices to robot coordinates.
+func (p polygon) toRobot(frame coords.Frame, system coords.System) (polygon, error) {
+    converted := make(polygon, len(p))
+
+    for index, ring := range p {
+        converted[index] = make([]polygonPoint, len(ring))
+
+        for i, point := range ring {
+            x, y, err := frame.ToRobot(system, point.X, point.Y)
+            if err != nil {
+                return nil, err
+            }
+
+            converted[index][i] = polygonPoint{float64(x), float64(y)}
+        }
+    }
+
+    return converted, nil
+}
+
+func (p polygon) contains(x float64, y float64) bool {
+    inside := false
+
+    for _, ring := range p {
+        for i, j := 0, len(ring) - 1; i < len(ring); j, i = i, i + 1 {
+            a, b := ring[i], ring[j]
+
+            if (a.Y > y) != (b.Y > y) && x < (b.X - a.X) * (y - a.Y) / (b.Y - a.Y) + a.X {
+                inside = !inside
+            }
+        }
+    }
+
+    return inside
+}
+
+func (p polygon) bounds() (float64, float64, float64, float64) {
+    minX, minY := math.Inf(1), math.Inf(1)
+    maxX, maxY := math.Inf(-1), math.Inf(-1)
+
+    for _, ring := range p {
+        for _, point := range ring {
+            minX, maxX = math.Min(minX, point.X), math.Max(maxX, point.X)
+            minY, maxY = math.Min(minY, point.Y), math.Max(maxY, point.Y)
+        }
+    }
+
+    return minX, minY, maxX, maxY
+}
+
+// decompose covers the polygon (in robot coordinates) with at most limit
+// non-overlapping zones, greedily taking the largest rectangle that fits
+// into the uncovered cells. Returns the zones and the number of cells of
+// the polygon and of those left uncovered.
+func (p polygon) decompose(limit int, repeats int) (RoomZones, int, int) {
+    minX, minY, maxX, maxY := p.bounds()
+
+    left := int(math.Floor(minX / polygonCellSize)) * polygonCellSize
+    bottom := int(math.Floor(minY / polygonCellSize)) * polygonCellSize
+    width := int(math.Ceil((maxX - float64(left)) / polygonCellSize))
+    height := int(math.Ceil((maxY - float64(bottom)) / polygonCellSize))
+
+    open := make([][]bool, height)
+    cells := 0
+    for y := range open {
+        open[y] = make([]bool, width)
+
+        for x := range open[y] {
+            cx := float64(left + x * polygonCellSize) + polygonCellSize / 2
+            cy := float64(bottom + y * polygonCellSize) + polygonCellSize / 2
+
+            if p.contains(cx, cy) {
+                open[y][x] = true
+                cells++
+            }
+        }
+    }
+
+    zones := RoomZones{}
+    remaining := cells
+
+    for len(zones) < limit && remaining > 0 {
+        x1, y1, x2, y2 := largestRectangle(open)
+
+        for y := y1; y < y2; y++ {
+            for x := x1; x < x2; x++ {
+                open[y][x] = false
+            }
+        }
+        remaining -= (x2 - x1) * (y2 - y1)
+
+        zones = append(zones, Zone{
+            X1: left + x1 * polygonCellSize,
+            Y1: bottom + y1 * polygonCellSize,
+            X2: left + x2 * polygonCellSize,
+            Y2: bottom + y2 * polygonCellSize,
+            Repeats: repeats,
+        })
+    }
+
+    return zones, cells, remaining
+}
+
+// largestRectangle finds the largest all-true rectangle of the grid using
+// the histogram method. The result is half-open.
+func largestRectangle(grid [][]bool) (int, int, int, int) {
+    if len(grid) == 0 {
+        return 0, 0, 0, 0
+    }
+
+    heights := make([]int, len(grid[0]))
+    best := 0
+    var bx1, by1, bx2, by2 int
+
+    for y, row := range grid {
+        for x, open := range row {
+            if open {
+                heights[x]++
+            } else {
+                heights[x] = 0
+            }
+        }
+
+        var stack []int
+        for x := 0; x <= len(heights); x++ {
+            h := 0
+            if x < len(heights) {
+                h = heights[x]
+            }
+
+            for len(stack) > 0 && heights[stack[len(stack) - 1]] >= h {
+                top := stack[len(stack) - 1]
+                stack = stack[:len(stack) - 1]
+
+                start := 0
+                if len(stack) > 0 {
+                    start = stack[len(stack) - 1] + 1
+                }
+
+                if area := heights[top] * (x - start); area > best {
+                    best = area
+                    bx1, bx2 = start, x
+                    by1, by2 = y + 1 - heights[top], y + 1
+                }
+            }
+
+            stack = append(stack, x)
+        }
+    }
+
+    return bx1, by1, bx2, by2
+}
+
+// importRoomPolygon turns an outline into a room and stores it.
+func importRoomPolygon(data []byte) (*RoomImportResult, error) {
+    var system struct {
+        Coordinates string  `json:"coordinates"`
+    }
+
+    if err := json.Unmarshal(data, &system); err != nil {
+        return nil, err
+    }
+
+    coordinateSystem, err := coords.ParseSystem(system.Coordinates)
+    if err != nil {
+        return nil, err
+    }
+
+    var request RoomImportRequest
+    if err := decodeWithCoordinates(data, &request); err != nil {
+        return nil, err
+    }
+
+    var outline polygon
+    switch {
+    case request.SVG != "" && len(request.GeoJSON) == 0:
+        outline, err = parseSVGPath(request.SVG)
+    case request.SVG == "" && len(request.GeoJSON) > 0:
+        outline, err = parseGeoJSON(request.GeoJSON)
+    default:
+        err = errors.New("Either svg or geojson is required!")
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    var frame coords.Frame
+    if coordinateSystem != coords.Robot {
+        if frame, err = coordinateFrame(); err != nil {
+            return nil, err
+        }
+    }
+
+    if outline, err = outline.toRobot(frame, coordinateSystem); err != nil {
+        return nil, err
+    }
+
+    minX, minY, maxX, maxY := outline.bounds()
+    if minX < mapMinCoordinate || minY < mapMinCoordinate || maxX > mapMaxCoordinate || maxY > mapMaxCoordinate {
+        return nil, errors.New("Outline is outside of the map!")
+    }
+
+    repeats := 1
+    if request.Repeat != 0 {
+        repeats = request.Repeat
+    }
+
+    room := request.Room
+    zones, cells, uncovered := outline.decompose(maxZones, repeats)
+    if cells == 0 {
+        return nil, errors.New("Outline does not cover a single map cell!")
+    }
+    room.Zones = zones
+
+    if err := setRoom(room); err != nil {
+        return nil, err
+    }
+
+    return &RoomImportResult{
+        Room: room,
+        Uncovered: float64(uncovered) / float64(cells),
+        UncoveredArea: float64(uncovered * polygonCellSize * polygonCellSize) / 1e6,
+        Warning: checkIdlePoint(room),
+    }, nil
+}
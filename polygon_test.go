@@ -0,0 +1,177 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseSVGPath(t *testing.T) {
+    square := []polygonPoint{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+
+    tests := []struct {
+        d           string
+        expected    polygon
+    }{
+        {"M0 0 H10 V10 H0 Z", polygon{square}},
+        {"M0,0 L10,0 10,10 0,10 z", polygon{square}},
+        {"m0 0 l10 0 0 10 -10 0 z", polygon{square}},
+        {"m0 0h10v10h-10z", polygon{square}},
+        // Exponents and minus signs as separators
+        {"M0-0L1e1-0L10 1e1L0 10Z", polygon{square}},
+        // Without Z the ring is closed implicitly
+        {"M0 0 H10 V10 H0", polygon{square}},
+        // A relative move after Z starts at the previous subpath's start
+        {
+            "M10 10 h10 v10 h-10 z m5 5 h5 v5 h-5 z",
+            polygon{
+                {{10, 10}, {20, 10}, {20, 20}, {10, 20}},
+                {{15, 15}, {20, 15}, {20, 20}, {15, 20}},
+            },
+        },
+        // So do lines drawn right after Z
+        {
+            "M10 10 h10 v10 h-10 z h5 v5 h-5 z",
+            polygon{
+                {{10, 10}, {20, 10}, {20, 20}, {10, 20}},
+                {{10, 10}, {15, 10}, {15, 15}, {10, 15}},
+            },
+        },
+        {
+            "M10 10 h10 v10 h-10 Z L0 0 0 10",
+            polygon{
+                {{10, 10}, {20, 10}, {20, 20}, {10, 20}},
+                {{10, 10}, {0, 0}, {0, 10}},
+            },
+        },
+    }
+
+    for _, test := range tests {
+        rings, err := parseSVGPath(test.d)
+        if err != nil {
+            t.Errorf("Path %q rejected: %s", test.d, err.Error())
+            continue
+        }
+
+        if !reflect.DeepEqual(rings, test.expected) {
+            t.Errorf("Path %q parsed as %v, expected %v", test.d, rings, test.expected)
+        }
+    }
+}
+
+func TestParseSVGPathInvalid(t *testing.T) {
+    invalid := []string{
+        "",
+        "0 0 10 10",
+        "M0 0 C10 0 10 10 0 10 Z",
+        "M0 0 L10",
+        "M0 0 Lx 10",
+        // Lines have no area
+        "M0 0 L10 10 Z",
+    }
+
+    for _, d := range invalid {
+        if _, err := parseSVGPath(d); err == nil {
+            t.Errorf("Path %q accepted", d)
+        }
+    }
+}
+
+func TestParseGeoJSON(t *testing.T) {
+    ring := `[[0,0],[10,0],[10,10],[0,10],[0,0]]`
+    expected := polygon{{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}}
+
+    valid := []string{
+        `{"type":"Polygon","coordinates":[` + ring + `]}`,
+        `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[` + ring + `]}}`,
+        `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"MultiPolygon","coordinates":[[` + ring + `]]}}]}`,
+    }
+
+    for _, data := range valid {
+        rings, err := parseGeoJSON([]byte(data))
+        if err != nil {
+            t.Errorf("GeoJSON %s rejected: %s", data, err.Error())
+            continue
+        }
+
+        if !reflect.DeepEqual(rings, expected) {
+            t.Errorf("GeoJSON %s parsed as %v", data, rings)
+        }
+    }
+
+    invalid := []string{
+        `{"type":"Point","coordinates":[0,0]}`,
+        `{"type":"FeatureCollection","features":[]}`,
+        `{"type":"Polygon","coordinates":[[[0,0],[10,10]]]}`,
+        `{"type":"Polygon","coordinates":"0,0"}`,
+        `[]`,
+    }
+
+    for _, data := range invalid {
+        if _, err := parseGeoJSON([]byte(data)); err == nil {
+            t.Errorf("GeoJSON %s accepted", data)
+        }
+    }
+}
+
+func rectanglePolygon(x1 float64, y1 float64, x2 float64, y2 float64) []polygonPoint {
+    return []polygonPoint{{x1, y1}, {x2, y1}, {x2, y2}, {x1, y2}}
+}
+
+func TestPolygonDecompose(t *testing.T) {
+    square := polygon{rectanglePolygon(25000, 25000, 26000, 26500)}
+
+    zones, cells, uncovered := square.decompose(maxZones, 2)
+    if !reflect.DeepEqual(zones, RoomZones{{25000, 25000, 26000, 26500, 2}}) || cells != 600 || uncovered != 0 {
+        t.Errorf("Square decomposed into %v, %d cells, %d uncovered", zones, cells, uncovered)
+    }
+
+    // L shape, the long leg is taken first
+    shape := polygon{{
+        {25000, 25000}, {27000, 25000}, {27000, 25500}, {25500, 25500}, {25500, 26000}, {25000, 26000},
+    }}
+
+    zones, cells, uncovered = shape.decompose(maxZones, 1)
+    expected := RoomZones{{25000, 25000, 27000, 25500, 1}, {25000, 25500, 25500, 26000, 1}}
+    if !reflect.DeepEqual(zones, expected) || cells != 500 || uncovered != 0 {
+        t.Errorf("L shape decomposed into %v, %d cells, %d uncovered", zones, cells, uncovered)
+    }
+
+    zones, _, uncovered = shape.decompose(1, 1)
+    if len(zones) != 1 || uncovered != 100 {
+        t.Errorf("L shape limited to one zone: %v, %d uncovered", zones, uncovered)
+    }
+
+    // Inner rings are holes
+    donut := polygon{
+        rectanglePolygon(25000, 25000, 26000, 26000),
+        rectanglePolygon(25250, 25250, 25750, 25750),
+    }
+
+    zones, cells, uncovered = donut.decompose(maxZones, 1)
+    if cells != 300 || uncovered != 0 || len(zones) != 4 {
+        t.Fatalf("Donut decomposed into %v, %d cells, %d uncovered", zones, cells, uncovered)
+    }
+
+    for _, zone := range zones {
+        if zone.X1 < 25750 && zone.X2 > 25250 && zone.Y1 < 25750 && zone.Y2 > 25250 {
+            t.Errorf("Zone %v overlaps the hole", zone)
+        }
+    }
+}
+
+func TestLargestRectangle(t *testing.T) {
+    grid := [][]bool{
+        {true, false, false, false},
+        {true, true, true, false},
+        {true, true, true, true},
+        {true, true, true, false},
+    }
+
+    if x1, y1, x2, y2 := largestRectangle(grid); x1 != 0 || y1 != 1 || x2 != 3 || y2 != 4 {
+        t.Errorf("Largest rectangle %d/%d-%d/%d", x1, y1, x2, y2)
+    }
+
+    if x1, y1, x2, y2 := largestRectangle(nil); x1 != 0 || y1 != 0 || x2 != 0 || y2 != 0 {
+        t.Errorf("Largest rectangle of nothing %d/%d-%d/%d", x1, y1, x2, y2)
+    }
+}
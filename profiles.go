@@ -0,0 +1,275 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+const (
+    profilesPath = roomControllerBasePath + "profiles.json"
+    profilesDirectory = "profiles"
+
+    // The default profile keeps the paths used before profiles existed
+    defaultProfileName = "default"
+
+    // Docks further away than this do not match a profile (mm)
+    profileDockTolerance = 500
+)
+
+// MapProfile is one floor with its own base map and room catalogue.
+type MapProfile struct {
+    Name    string          `json:"name"`
+    // Position of the dock on this floor's map
+    Dock    *rrmap.Pose     `json:"dock"`
+}
+
+type MapProfileStore struct {
+    Active      string                  `json:"active"`
+    Profiles    map[string]*MapProfile  `json:"profiles"`
+}
+
+var profilesMutex sync.Mutex
+var profiles = &MapProfileStore{
+    Active: defaultProfileName,
+    Profiles: map[string]*MapProfile{
+        defaultProfileName: &MapProfile{Name: defaultProfileName},
+    },
+}
+
+func profilePath(name string) string {
+    if name == defaultProfileName {
+        return roomControllerBasePath
+    }
+
+    return roomControllerBasePath + profilesDirectory + "/" + name + "/"
+}
+
+func activeProfile() string {
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    return profiles.Active
+}
+
+// baseMapPath returns the base map of the active profile.
+func baseMapPath() string {
+    return profilePath(activeProfile()) + baseMapName + "/"
+}
+
+func loadProfiles() error {
+    stored := &MapProfileStore{}
+
+    if err := ReadJSONFile(profilesPath, stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    if stored.Profiles == nil {
+        stored.Profiles = map[string]*MapProfile{}
+    }
+
+    if stored.Profiles[defaultProfileName] == nil {
+        stored.Profiles[defaultProfileName] = &MapProfile{Name: defaultProfileName}
+    }
+
+    if stored.Profiles[stored.Active] == nil {
+        stored.Active = defaultProfileName
+    }
+
+    profilesMutex.Lock()
+    profiles = stored
+    profilesMutex.Unlock()
+
+    return loadProfileData(stored.Active)
+}
+
+// loadProfileData loads everything stored per profile.
+func loadProfileData(name string) error {
+    if err := loadRooms(profilePath(name) + "rooms.json"); err != nil {
+        return err
+    }
+
+    if err := loadNoGoAreas(profilePath(name) + "nogo.json"); err != nil {
+        return err
+    }
+
+    if err := loadLocations(profilePath(name) + "locations.json"); err != nil {
+        return err
+    }
+
+    if err := loadRoutes(profilePath(name) + "routes.json"); err != nil {
+        return err
+    }
+
+    return loadRecipes(profilePath(name) + "recipes.json")
+}
+
+func listProfiles() []MapProfile {
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    list := make([]MapProfile, 0, len(profiles.Profiles))
+    for _, profile := range profiles.Profiles {
+        list = append(list, *profile)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+// setProfile creates or updates a profile. Without a dock position the one
+// of the live map is stored.
+func setProfile(profile MapProfile) error {
+    if err := validateMapName(profile.Name); err != nil {
+        return err
+    }
+
+    if profile.Dock == nil {
+        dock, err := rrmap.ReadPose(rockroboBasePath + "ChargerPos.data")
+        if err != nil {
+            return err
+        }
+
+        profile.Dock = dock
+    }
+
+    if err := os.MkdirAll(profilePath(profile.Name), os.ModePerm); err != nil {
+        return err
+    }
+
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    previous := profiles.Profiles[profile.Name]
+    profiles.Profiles[profile.Name] = &profile
+
+    if err := WriteJSONFile(profilesPath, profiles); err != nil {
+        if previous != nil {
+            profiles.Profiles[profile.Name] = previous
+        } else {
+            delete(profiles.Profiles, profile.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteProfile(name string) error {
+    if name == defaultProfileName {
+        return errors.New("The default profile cannot be deleted!")
+    }
+
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    profile, ok := profiles.Profiles[name]
+    if !ok {
+        return errors.New("Unknown profile " + name + "!")
+    }
+
+    if name == profiles.Active {
+        return errors.New("Profile " + name + " is active!")
+    }
+
+    delete(profiles.Profiles, name)
+    if err := WriteJSONFile(profilesPath, profiles); err != nil {
+        profiles.Profiles[name] = profile
+        return err
+    }
+
+    return os.RemoveAll(profilePath(name))
+}
+
+// selectProfile makes name the profile room commands work on.
+func selectProfile(name string) error {
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    profile, ok := profiles.Profiles[name]
+    if !ok {
+        return errors.New("Unknown profile " + name + "!")
+    }
+
+    // Docking at the end of a job selects the profile it already runs in
+    if name == profiles.Active {
+        return nil
+    }
+
+    if Jobs.Active() != nil {
+        return errors.New("Cannot switch profiles while a job is running!")
+    }
+
+    if err := loadProfileData(name); err != nil {
+        return err
+    }
+
+    previous := profiles.Active
+    profiles.Active = name
+
+    if err := WriteJSONFile(profilesPath, profiles); err != nil {
+        profiles.Active = previous
+        loadProfileData(previous)
+        return err
+    }
+
+    fmt.Printf("Selected profile %s.\n", name)
+
+    publishJSON(profileActiveTopic, true, profile)
+
+    return nil
+}
+
+// matchProfile returns the profile whose dock is closest to dock, or an empty
+// string if none is within profileDockTolerance.
+func matchProfile(dock *rrmap.Pose) string {
+    profilesMutex.Lock()
+    defer profilesMutex.Unlock()
+
+    match := ""
+    distance := float64(profileDockTolerance)
+    for name, profile := range profiles.Profiles {
+        if profile.Dock == nil {
+            continue
+        }
+
+        if d := profile.Dock.Distance(dock); d <= distance {
+            match = name
+            distance = d
+        }
+    }
+
+    return match
+}
+
+// selectProfileByDock switches to the profile matching the dock of the live
+// map. Explicitly selected profiles are kept if no profile matches.
+func selectProfileByDock() error {
+    dock, err := rrmap.ReadPose(rockroboBasePath + "ChargerPos.data")
+    if err != nil {
+        return err
+    }
+
+    name := matchProfile(dock)
+    if name == "" {
+        return nil
+    }
+
+    return selectProfile(name)
+}
+
+func publishActiveProfile() {
+    profilesMutex.Lock()
+    profile := *profiles.Profiles[profiles.Active]
+    profilesMutex.Unlock()
+
+    publishJSON(profileActiveTopic, true, profile)
+}
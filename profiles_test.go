@@ -0,0 +1,38 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestSelectProfileWhileJobRuns(t *testing.T) {
+    previousProfiles, previousJob := profiles, Jobs.active
+    defer func() {
+        profiles, Jobs.active = previousProfiles, previousJob
+    }()
+
+    profiles = &MapProfileStore{
+        Active: "upstairs",
+        Profiles: map[string]*MapProfile{
+            "upstairs": {Name: "upstairs"},
+            "downstairs": {Name: "downstairs"},
+        },
+    }
+    Jobs.active = &Job{ID: "1", Kind: "clean_rooms"}
+
+    // Docking at the end of the job matches the active profile again
+    if err := selectProfile("upstairs"); err != nil {
+        t.Fatal(err)
+    }
+
+    if selectProfile("downstairs") == nil {
+        t.Fatal("Profile switched while a job is running")
+    }
+
+    if selectProfile("attic") == nil {
+        t.Fatal("Unknown profile selected")
+    }
+
+    if profiles.Active != "upstairs" {
+        t.Fatalf("Active profile %s", profiles.Active)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const readinessPollInterval = 2 * time.Second
+
+// Subset of *miio.Vacuum used while waiting for the robot.
+type readinessVacuum interface {
+    UpdateStatus() bool
+    Snapshot() miio.VacuumState
+}
+
+// waitReady polls the robot after rrwatchdoge got reloaded until it answers,
+// has loaded a map and is back on the dock.
+//
+// The status from before the reload still looks ready, so a status only
+// counts once the restart has been seen: a poll that failed or a status that
+// differs from the one before the reload. get_status responses are parsed
+// asynchronously, a status counts for the poll it was received after.
+func waitReady(vacuum readinessVacuum, timeout time.Duration) error {
+    started := jobClock.Now()
+    deadline := started.Add(timeout)
+    before := vacuum.Snapshot()
+    restarted := false
+    reason := "no restart seen"
+
+    for {
+        polled := vacuum.Snapshot().Updated
+        answered := vacuum.UpdateStatus()
+
+        jobClock.Sleep(readinessPollInterval)
+
+        state := vacuum.Snapshot()
+
+        switch {
+        case !answered:
+            restarted = true
+            reason = "no response"
+        case !state.Updated.After(polled):
+            reason = "no status received"
+        case !restarted:
+            if state.State == before.State && state.MapPresent == before.MapPresent {
+                reason = "no restart seen"
+                break
+            }
+
+            // Readiness is judged by the statuses that follow
+            fmt.Printf("Robot restart seen after %s.\n", jobClock.Since(started).Round(time.Second))
+            restarted = true
+            reason = fmt.Sprintf("restarting in state %d", state.State)
+        case !state.MapPresent:
+            reason = "no map loaded"
+        case state.State != miio.VacStateCharging && state.State != miio.VacStateFullyCharged:
+            reason = fmt.Sprintf("state %d", state.State)
+        default:
+            fmt.Printf("Robot ready after %s.\n", jobClock.Since(started).Round(time.Second))
+            return nil
+        }
+
+        if jobClock.Now().After(deadline) {
+            return errors.New("Robot not ready after " + timeout.String() + ": " + reason + "!")
+        }
+    }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/benbjohnson/clock"
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+// A poll the fake robot answers, with the status it reports afterwards or
+// nil if no status arrives.
+type readinessPoll struct {
+    answered    bool
+    state       *miio.VacuumState
+}
+
+type fakeReadinessVacuum struct {
+    state       miio.VacuumState
+    polls       []readinessPoll
+}
+
+func (v *fakeReadinessVacuum) UpdateStatus() bool {
+    poll := v.polls[0]
+    if len(v.polls) > 1 {
+        v.polls = v.polls[1:]
+    }
+
+    if poll.state != nil {
+        updated := v.state.Updated.Add(time.Second)
+        v.state = *poll.state
+        v.state.Updated = updated
+    }
+
+    return poll.answered
+}
+
+func (v *fakeReadinessVacuum) Snapshot() miio.VacuumState {
+    return v.state
+}
+
+func runWaitReady(t *testing.T, vacuum *fakeReadinessVacuum, timeout time.Duration, polls int) error {
+    t.Helper()
+
+    testClock := &recoveryTestClock{Mock: clock.NewMock(), timers: make(chan time.Duration, 1)}
+    previous := jobClock
+    jobClock = testClock
+    defer func() { jobClock = previous }()
+
+    done := make(chan error, 1)
+    go func() {
+        done <- waitReady(vacuum, timeout)
+    }()
+
+    for poll := 0; poll < polls; poll++ {
+        select {
+        case d := <-testClock.timers:
+            if d != readinessPollInterval {
+                t.Fatalf("Poll %d waited %s", poll, d)
+            }
+        case <-time.After(recoveryTestWait):
+            t.Fatalf("Poll %d did not wait", poll)
+        }
+
+        testClock.Add(readinessPollInterval)
+    }
+
+    select {
+    case err := <-done:
+        return err
+    case <-time.After(recoveryTestWait):
+        t.Fatalf("Still waiting after %d polls", polls)
+    }
+
+    return nil
+}
+
+func TestWaitReady(t *testing.T) {
+    docked := miio.VacuumState{State: miio.VacStateCharging, MapPresent: true}
+    booting := miio.VacuumState{State: miio.VacStateIdle}
+
+    tests := []struct {
+        name        string
+        polls       []readinessPoll
+    }{
+        {"restart without response", []readinessPoll{
+            {answered: false},
+            {answered: true, state: &booting},
+            {answered: true, state: &docked},
+        }},
+        {"restart seen in the status", []readinessPoll{
+            {answered: true, state: &docked},
+            {answered: true, state: &booting},
+            {answered: true},
+            {answered: true, state: &docked},
+        }},
+    }
+
+    for _, test := range tests {
+        vacuum := &fakeReadinessVacuum{state: docked, polls: test.polls}
+
+        if err := runWaitReady(t, vacuum, time.Minute, len(test.polls)); err != nil {
+            t.Errorf("%s: %s", test.name, err.Error())
+        }
+    }
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+    docked := miio.VacuumState{State: miio.VacStateCharging, MapPresent: true}
+    vacuum := &fakeReadinessVacuum{state: docked, polls: []readinessPoll{{answered: true, state: &docked}}}
+
+    // The status from before the reload never counts as ready
+    err := runWaitReady(t, vacuum, 5 * time.Second, 3)
+    if err == nil || !strings.Contains(err.Error(), "no restart seen") {
+        t.Fatalf("Unexpected result %v", err)
+    }
+}
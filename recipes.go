@@ -0,0 +1,470 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+// Recipe step actions
+const (
+    recipeActionZones = "zones"
+    recipeActionSpot = "spot"
+    recipeActionGoto = "goto"
+)
+
+// Spot cleans take about two minutes
+const recipeSpotTimeout = 10 * time.Minute
+
+// RecipeStep is one pass of a recipe. Zones come from a stored room or are
+// given inline, positions from a named location or a point.
+type RecipeStep struct {
+    Action      string          `json:"action"`
+    Room        string          `json:"room,omitempty"`
+    Zones       RoomZones       `json:"zones,omitempty"`
+    FanPower    int             `json:"fan_power,omitempty"`
+    Location    string          `json:"location,omitempty"`
+    Point       Coordinates     `json:"point,omitempty"`
+    // Seconds to wait after a goto
+    Wait        int             `json:"wait,omitempty"`
+    // Seconds the step may take, defaults depend on the action
+    Timeout     int             `json:"timeout,omitempty"`
+}
+
+// Recipe chains cleaning passes, e.g. a turbo pass over the dining table
+// followed by a quiet pass over the rest of the kitchen.
+//
+// The robot heads home after a zoned clean, so recipes ending with a zones
+// step always dock through a recovery strategy. Strategy and idle point
+// default to the ones of the room of that step. Dock only applies to recipes
+// ending with a spot or goto step.
+type Recipe struct {
+    Name        string          `json:"name"`
+    Steps       []RecipeStep    `json:"steps"`
+    Dock        bool            `json:"dock"`
+    Strategy    string          `json:"strategy,omitempty"`
+    IdlePoint   Coordinates     `json:"idle_point,omitempty"`
+}
+
+type RecipeProgress struct {
+    Recipe          string  `json:"recipe"`
+    Step            int     `json:"step"`
+    Steps           int     `json:"steps"`
+    Action          string  `json:"action"`
+    // Zone batch of a zones step
+    Batch           int     `json:"batch"`
+    Batches         int     `json:"batches"`
+    // See RoomProgress
+    ZoneProgress    bool    `json:"zone_progress"`
+}
+
+var recipesMutex sync.Mutex
+var recipes = map[string]Recipe{}
+// Recipes of the active profile
+var recipesPath string
+
+func (step RecipeStep) timeout(fallback time.Duration) time.Duration {
+    if step.Timeout > 0 {
+        return time.Duration(step.Timeout) * time.Second
+    }
+
+    return fallback
+}
+
+// zones returns the zones of a zones step with the no-go areas taken out.
+func (step RecipeStep) zones() (RoomZones, error) {
+    zones := step.Zones
+
+    if step.Room != "" {
+        room, err := getRoom(step.Room)
+        if err != nil {
+            return nil, err
+        }
+
+        zones = room.Zones
+    }
+
+    if zones = applyNoGoAreas(zones); len(zones) == 0 {
+        return nil, errors.New("All zones are within no-go areas!")
+    }
+
+    return zones, zones.Validate()
+}
+
+// target returns the position of a spot or goto step.
+func (step RecipeStep) target() (Coordinates, error) {
+    waypoint := Waypoint{Location: step.Location, Point: step.Point}
+
+    return waypoint.resolve()
+}
+
+func (step RecipeStep) Validate() error {
+    switch step.Action {
+    case recipeActionZones:
+        if (step.Room == "") == (len(step.Zones) == 0) {
+            return errors.New("Zones step needs either a room or zones!")
+        }
+
+        if len(step.Zones) > 0 {
+            if err := step.Zones.Validate(); err != nil {
+                return err
+            }
+        }
+    case recipeActionSpot, recipeActionGoto:
+        if (step.Location == "") == (step.Point == nil) {
+            return errors.New(step.Action + " step needs either a location or a point!")
+        }
+
+        if step.Point != nil {
+            if err := validatePoint(step.Point); err != nil {
+                return err
+            }
+        }
+    default:
+        return errors.New("Unknown recipe action " + step.Action + "!")
+    }
+
+    if step.FanPower < 0 || step.FanPower > 100 {
+        return fmt.Errorf("Fan power %d is not between 0 and 100!", step.FanPower)
+    }
+
+    if step.Wait < 0 || step.Wait > maxRouteWait {
+        return fmt.Errorf("Wait time must be between 0 and %d seconds!", maxRouteWait)
+    }
+
+    if step.Timeout < 0 {
+        return errors.New("Negative timeout!")
+    }
+
+    return nil
+}
+
+func (recipe Recipe) Validate() error {
+    if recipe.Name == "" {
+        return errors.New("Recipe without name!")
+    }
+
+    if len(recipe.Steps) == 0 {
+        return errors.New("Recipe " + recipe.Name + " has no steps!")
+    }
+
+    for index, step := range recipe.Steps {
+        if err := step.Validate(); err != nil {
+            return fmt.Errorf("Step %d: %s", index, err.Error())
+        }
+    }
+
+    if recipe.IdlePoint != nil {
+        if err := validatePoint(recipe.IdlePoint); err != nil {
+            return errors.New("Idle point: " + err.Error())
+        }
+    }
+
+    last := recipe.Steps[len(recipe.Steps) - 1]
+    if last.Action == recipeActionZones && last.Room == "" && recipe.IdlePoint == nil {
+        return errors.New("Recipe ending with inline zones needs an idle point!")
+    }
+
+    return nil
+}
+
+// dockRoom returns the room whose strategy and idle point dock a recipe
+// ending with a zones step.
+func (recipe Recipe) dockRoom() (Room, error) {
+    last := recipe.Steps[len(recipe.Steps) - 1]
+    room := Room{Name: recipe.Name}
+
+    if last.Room != "" {
+        var err error
+        if room, err = getRoom(last.Room); err != nil {
+            return Room{}, err
+        }
+    }
+
+    if recipe.Strategy != "" {
+        room.Strategy = recipe.Strategy
+    }
+
+    if recipe.IdlePoint != nil {
+        room.IdlePoint = recipe.IdlePoint
+    }
+
+    strategy, err := getRecoveryStrategy(room.Strategy)
+    if err != nil {
+        return Room{}, err
+    }
+
+    if err := checkNoGo(room.IdlePoint[0], room.IdlePoint[1]); err != nil {
+        return Room{}, errors.New("Idle point " + err.Error())
+    }
+
+    if err := strategy.checkNoGoPoints(room.IdlePoint); err != nil {
+        return Room{}, err
+    }
+
+    return room, nil
+}
+
+func loadRecipes(path string) error {
+    stored := map[string]Recipe{}
+
+    if err := ReadJSONFile(path, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    recipesMutex.Lock()
+    recipes = stored
+    recipesPath = path
+    recipesMutex.Unlock()
+
+    return nil
+}
+
+func getRecipe(name string) (Recipe, error) {
+    recipesMutex.Lock()
+    defer recipesMutex.Unlock()
+
+    recipe, ok := recipes[name]
+    if !ok {
+        return Recipe{}, errors.New("Unknown recipe " + name + "!")
+    }
+
+    return recipe, nil
+}
+
+func listRecipes() []Recipe {
+    recipesMutex.Lock()
+    defer recipesMutex.Unlock()
+
+    list := make([]Recipe, 0, len(recipes))
+    for _, recipe := range recipes {
+        list = append(list, recipe)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+func setRecipe(recipe Recipe) error {
+    if err := recipe.Validate(); err != nil {
+        return err
+    }
+
+    recipesMutex.Lock()
+    defer recipesMutex.Unlock()
+
+    previous, existed := recipes[recipe.Name]
+    recipes[recipe.Name] = recipe
+
+    if err := WriteJSONFile(recipesPath, recipes); err != nil {
+        if existed {
+            recipes[recipe.Name] = previous
+        } else {
+            delete(recipes, recipe.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteRecipe(name string) error {
+    recipesMutex.Lock()
+    defer recipesMutex.Unlock()
+
+    recipe, ok := recipes[name]
+    if !ok {
+        return errors.New("Unknown recipe " + name + "!")
+    }
+
+    delete(recipes, name)
+    if err := WriteJSONFile(recipesPath, recipes); err != nil {
+        recipes[name] = recipe
+        return err
+    }
+
+    return nil
+}
+
+// waitSpotFinished waits for a spot clean to start and end.
+func waitSpotFinished(job *Job, timeout time.Duration) error {
+    started := false
+
+    return job.waitForState(func(state miio.VacState) bool {
+        switch state {
+        case miio.VacStateSpot:
+            started = true
+        case miio.VacStateIdle, miio.VacStateReturning, miio.VacStateCharging:
+            return started
+        }
+
+        return false
+    }, timeout)
+}
+
+// runRecipeStep executes a step and waits for its success condition. The
+// last batch of a zones step is handed to the dock recovery when dock is set.
+func runRecipeStep(job *Job, progress RecipeProgress, step RecipeStep, fan *jobFanPower, dock *Room) error {
+    fan.set(step.FanPower)
+
+    switch step.Action {
+    case recipeActionZones:
+        zones, err := step.zones()
+        if err != nil {
+            return err
+        }
+
+        batches := zones.Batches()
+        for number, batch := range batches {
+            batch := batch
+
+            if err := job.poll(); err != nil {
+                return err
+            }
+
+            progress.Batch = number
+            progress.Batches = len(batches)
+            job.publishProgress(progress)
+
+            job.OnResume = func() {
+                Vacuum.ZonedClean(batch.Params())
+            }
+
+            Vacuum.ZonedClean(batch.Params())
+
+            if dock != nil && number == len(batches) - 1 {
+                return returnToDock(job, *dock, batch)
+            }
+
+            err := waitZoneCleanFinished(job, step.timeout(defaultRecoveryTimeouts[recoveryStateCleaning]))
+            if err != nil {
+                return err
+            }
+
+            job.OnResume = nil
+        }
+    case recipeActionSpot, recipeActionGoto:
+        target, err := step.target()
+        if err != nil {
+            return err
+        }
+
+        job.publishProgress(progress)
+
+        if err := driveTo(job, target); err != nil {
+            return err
+        }
+
+        if step.Action == recipeActionGoto {
+            job.OnResume = nil
+
+            return job.sleep(time.Duration(step.Wait) * time.Second)
+        }
+
+        job.OnResume = func() {
+            Vacuum.SpotClean()
+        }
+
+        Vacuum.SpotClean()
+
+        if err := waitSpotFinished(job, step.timeout(recipeSpotTimeout)); err != nil {
+            return err
+        }
+
+        job.OnResume = nil
+    }
+
+    return nil
+}
+
+// runRecipe executes a recipe as a job.
+func runRecipe(name string) (*Job, error) {
+    recipe, err := getRecipe(name)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := checkBlackout(); err != nil {
+        return nil, err
+    }
+
+    // Fail early on rooms or locations that went away
+    for index, step := range recipe.Steps {
+        switch step.Action {
+        case recipeActionZones:
+            _, err = step.zones()
+        default:
+            var target Coordinates
+            if target, err = step.target(); err == nil {
+                err = checkNoGo(target[0], target[1])
+            }
+        }
+
+        if err != nil {
+            return nil, fmt.Errorf("Step %d: %s", index, err.Error())
+        }
+    }
+
+    var dock *Room
+    if recipe.Steps[len(recipe.Steps) - 1].Action == recipeActionZones {
+        room, err := recipe.dockRoom()
+        if err != nil {
+            return nil, err
+        }
+
+        dock = &room
+    }
+
+    return Jobs.Start("recipe", JobLimits{}, func(job *Job) error {
+        var fan jobFanPower
+        defer fan.restore()
+
+        // Zones and locations refer to the base map
+        if err := restoreBaseMap(false); err != nil {
+            return err
+        }
+
+        for index, step := range recipe.Steps {
+            if err := job.poll(); err != nil {
+                return err
+            }
+
+            fmt.Printf("Recipe %s: step %d (%s).\n", recipe.Name, index, step.Action)
+
+            progress := RecipeProgress{
+                Recipe: recipe.Name,
+                Step: index,
+                Steps: len(recipe.Steps),
+                Action: step.Action,
+            }
+
+            var stepDock *Room
+            if index == len(recipe.Steps) - 1 {
+                stepDock = dock
+            }
+
+            if err := runRecipeStep(job, progress, step, &fan, stepDock); err != nil {
+                if err == errJobCancelled {
+                    return err
+                }
+
+                return fmt.Errorf("Step %d: %s", index, err.Error())
+            }
+        }
+
+        if dock == nil && recipe.Dock {
+            return waitDocked(job)
+        }
+
+        return nil
+    })
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "time"
+
+    "github.com/benbjohnson/clock"
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+// After restoring the base map the robot does not find its dock on the first
+// try. dockRecovery waits for the zoned clean to end and then runs the steps
+// of a RecoveryStrategy until the robot is charging again.
+type recoveryState int
+
+const (
+    // Give the zoned clean some time to get going
+    recoveryStateSettling recoveryState = iota
+    recoveryStateCleaning
+    recoveryStateReturning
+    // Running the strategy, see dockRecovery.step
+    recoveryStateRecovering
+    recoveryStateDocked
+    recoveryStateFailed
+    recoveryStateCancelled
+)
+
+var recoveryStateNames = map[recoveryState]string{
+    recoveryStateSettling: "settling",
+    recoveryStateCleaning: "cleaning",
+    recoveryStateReturning: "returning",
+    recoveryStateRecovering: "recovering",
+    recoveryStateDocked: "docked",
+    recoveryStateFailed: "failed",
+    recoveryStateCancelled: "cancelled",
+}
+
+// Time the FSM may stay in a state before timing out. Settling is a plain
+// delay, the steps of a strategy bring their own timeouts.
+var defaultRecoveryTimeouts = map[recoveryState]time.Duration{
+    recoveryStateSettling: 30 * time.Second,
+    recoveryStateCleaning: 4 * time.Hour,
+    recoveryStateReturning: 10 * time.Minute,
+}
+
+func (s recoveryState) String() string {
+    return recoveryStateNames[s]
+}
+
+func (s recoveryState) MarshalJSON() ([]byte, error) {
+    return json.Marshal(s.String())
+}
+
+func (s *recoveryState) UnmarshalJSON(data []byte) error {
+    var name string
+
+    if err := json.Unmarshal(data, &name); err != nil {
+        return err
+    }
+
+    for state, stateName := range recoveryStateNames {
+        if stateName == name {
+            *s = state
+            return nil
+        }
+    }
+
+    return fmt.Errorf("Unknown recovery state %s!", name)
+}
+
+func (s recoveryState) terminal() bool {
+    return s == recoveryStateDocked || s == recoveryStateFailed || s == recoveryStateCancelled
+}
+
+// Implemented by *Job. handleControl blocks while the job is paused.
+type recoveryControl interface {
+    Control() <-chan jobControl
+    handleControl(control jobControl) error
+}
+
+// Subset of *miio.Vacuum used by the recovery.
+type recoveryVacuum interface {
+    GotoTarget(x int, y int) bool
+    Dock() bool
+    SetVolume(val uint8) bool
+    FindMe() bool
+}
+
+type RecoveryTransition struct {
+    From        recoveryState   `json:"from"`
+    To          recoveryState   `json:"to"`
+    Strategy    string          `json:"strategy"`
+    Step        int             `json:"step"`
+    Action      string          `json:"action,omitempty"`
+    Reason      string          `json:"reason"`
+}
+
+type dockRecovery struct {
+    vacuum      recoveryVacuum
+    updates     <-chan *miio.DeviceUpdateMessage
+    clock       clock.Clock
+    control     recoveryControl
+    strategy    RecoveryStrategy
+    idlePoint   Coordinates
+    timeouts    map[recoveryState]time.Duration
+
+    OnTransition func(transition RecoveryTransition)
+
+    state       recoveryState
+    // Index of the running strategy step
+    step        int
+    // Whether the robot left the step's target state since the step started
+    stepMoved   bool
+    lastState   miio.VacState
+    timer       *clock.Timer
+    deadline    time.Time
+}
+
+func newDockRecovery(vacuum recoveryVacuum, updates <-chan *miio.DeviceUpdateMessage,
+        clk clock.Clock, control recoveryControl, strategy RecoveryStrategy, idlePoint Coordinates) *dockRecovery {
+    return &dockRecovery{
+        vacuum: vacuum,
+        updates: updates,
+        clock: clk,
+        control: control,
+        strategy: strategy,
+        idlePoint: idlePoint,
+        timeouts: defaultRecoveryTimeouts,
+        lastState: miio.VacStateZoneClean,
+    }
+}
+
+func (r *dockRecovery) State() recoveryState {
+    return r.state
+}
+
+// Step returns the index of the last strategy step that has been started.
+func (r *dockRecovery) Step() int {
+    return r.step
+}
+
+// Run blocks until the robot is docked, the recovery failed or got cancelled.
+func (r *dockRecovery) Run() recoveryState {
+    r.enter(recoveryStateSettling, "zoned clean started")
+
+    for !r.state.terminal() {
+        select {
+        case update, ok := <-r.updates:
+            if !ok {
+                r.enter(recoveryStateFailed, "update channel closed")
+                break
+            }
+
+            r.handleState(update.State.State)
+        case <-r.timer.C:
+            r.handleTimeout()
+        case control := <-r.control.Control():
+            r.handleControl(control)
+        }
+    }
+
+    return r.state
+}
+
+func (r *dockRecovery) enter(state recoveryState, reason string) {
+    r.transition(state, reason)
+
+    if timeout, ok := r.timeouts[state]; ok && !state.terminal() {
+        r.startTimer(timeout)
+    }
+}
+
+func (r *dockRecovery) transition(state recoveryState, reason string) {
+    transition := RecoveryTransition{
+        From: r.state,
+        To: state,
+        Strategy: r.strategy.Name,
+        Step: r.step,
+        Reason: reason,
+    }
+
+    if state == recoveryStateRecovering {
+        transition.Action = r.strategy.Steps[r.step].Action
+    }
+
+    fmt.Printf("Dock recovery: %s -> %s (%s)\n", r.state, state, reason)
+
+    r.state = state
+
+    if r.timer != nil {
+        r.timer.Stop()
+    }
+
+    if r.OnTransition != nil {
+        r.OnTransition(transition)
+    }
+}
+
+func (r *dockRecovery) startTimer(timeout time.Duration) {
+    r.deadline = r.clock.Now().Add(timeout)
+    r.timer = r.clock.Timer(timeout)
+}
+
+// Freezes the FSM while the job is paused and re-issues the last command
+// once it gets resumed.
+func (r *dockRecovery) handleControl(control jobControl) {
+    remaining := r.deadline.Sub(r.clock.Now())
+    r.timer.Stop()
+
+    if err := r.control.handleControl(control); err != nil {
+        r.enter(recoveryStateCancelled, err.Error())
+        return
+    }
+
+    r.startTimer(remaining)
+
+    // A returning pause means the job got resumed
+    if control != jobControlPause {
+        return
+    }
+
+    switch r.state {
+    case recoveryStateReturning:
+        r.vacuum.Dock()
+    case recoveryStateRecovering:
+        r.stepMoved = false
+        r.execute(r.strategy.Steps[r.step])
+    }
+}
+
+func (r *dockRecovery) handleState(state miio.VacState) {
+    changed := state != r.lastState
+    r.lastState = state
+
+    if r.state == recoveryStateSettling {
+        return
+    }
+
+    if state == miio.VacStateCharging || state == miio.VacStateFullyCharged {
+        r.enter(recoveryStateDocked, "charging")
+        return
+    }
+
+    if !changed {
+        return
+    }
+
+    switch r.state {
+    case recoveryStateCleaning:
+        switch state {
+        case miio.VacStateReturning:
+            r.enter(recoveryStateReturning, "returning to dock")
+        case miio.VacStateIdle:
+            r.startStep(0, "idle before reaching the dock")
+        }
+    case recoveryStateReturning:
+        if state == miio.VacStateIdle {
+            r.startStep(0, "idle before reaching the dock")
+        }
+    case recoveryStateRecovering:
+        step := r.strategy.Steps[r.step]
+        target, ok := recoveryConditionStates[step.Until]
+        if !ok {
+            return
+        }
+
+        if state != target {
+            r.stepMoved = true
+        } else if r.stepMoved {
+            r.startStep(r.step + 1, "step " + strconv.Itoa(r.step) + " reached " + step.Until)
+        }
+    }
+}
+
+func (r *dockRecovery) handleTimeout() {
+    switch r.state {
+    case recoveryStateSettling:
+        r.enter(recoveryStateCleaning, "settled")
+
+        // Catch up with whatever happened while settling
+        state := r.lastState
+        r.lastState = miio.VacStateUnknown
+        r.handleState(state)
+    case recoveryStateRecovering:
+        r.startStep(r.step + 1, "timeout in step " + strconv.Itoa(r.step))
+    default:
+        r.enter(recoveryStateFailed, "timeout in state " + r.state.String())
+    }
+}
+
+func (r *dockRecovery) startStep(index int, reason string) {
+    if index >= len(r.strategy.Steps) {
+        r.enter(recoveryStateFailed, "no recovery steps left")
+        return
+    }
+
+    step := r.strategy.Steps[index]
+
+    r.step = index
+    r.stepMoved = false
+    r.transition(recoveryStateRecovering, reason)
+    r.startTimer(time.Duration(step.Timeout) * time.Second)
+
+    r.execute(step)
+}
+
+func (r *dockRecovery) execute(step RecoveryStep) {
+    switch step.Action {
+    case recoveryActionGoto:
+        point := step.Point
+        if len(point) == 0 {
+            point = r.idlePoint
+        }
+
+        r.vacuum.GotoTarget(point[0], point[1])
+    case recoveryActionDock:
+        r.vacuum.Dock()
+    case recoveryActionVolume:
+        r.vacuum.SetVolume(uint8(step.Volume))
+    case recoveryActionFindMe:
+        r.vacuum.FindMe()
+    }
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/benbjohnson/clock"
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const recoveryTestWait = time.Second
+
+// Reports every timer the FSM starts, so tests only advance the clock once
+// the FSM is waiting on it. Expired timers are delivered after Add returns,
+// the mock still touches them while firing.
+type recoveryTestClock struct {
+    *clock.Mock
+
+    timers  chan time.Duration
+    fired   []chan time.Time
+}
+
+func (c *recoveryTestClock) Timer(d time.Duration) *clock.Timer {
+    fire := make(chan time.Time, 1)
+
+    timer := c.Mock.AfterFunc(d, func() {
+        c.fired = append(c.fired, fire)
+    })
+    timer.C = fire
+    c.timers <- d
+
+    return timer
+}
+
+func (c *recoveryTestClock) Sleep(d time.Duration) {
+    <-c.Timer(d).C
+}
+
+func (c *recoveryTestClock) Add(d time.Duration) {
+    c.Mock.Add(d)
+
+    for _, fire := range c.fired {
+        fire <- c.Now()
+    }
+    c.fired = nil
+}
+
+type fakeRecoveryVacuum struct {
+    commands    chan string
+}
+
+func (v *fakeRecoveryVacuum) GotoTarget(x int, y int) bool {
+    v.commands <- fmt.Sprintf("goto %d %d", x, y)
+    return true
+}
+
+func (v *fakeRecoveryVacuum) Dock() bool {
+    v.commands <- "dock"
+    return true
+}
+
+func (v *fakeRecoveryVacuum) SetVolume(val uint8) bool {
+    v.commands <- fmt.Sprintf("volume %d", val)
+    return true
+}
+
+func (v *fakeRecoveryVacuum) FindMe() bool {
+    v.commands <- "find_me"
+    return true
+}
+
+// Behaves like *Job: pausing blocks until resume or cancel arrive on the
+// same channel.
+type fakeRecoveryControl struct {
+    control chan jobControl
+    paused  chan bool
+}
+
+func (c *fakeRecoveryControl) Control() <-chan jobControl {
+    return c.control
+}
+
+func (c *fakeRecoveryControl) handleControl(control jobControl) error {
+    switch control {
+    case jobControlCancel:
+        return errJobCancelled
+    case jobControlPause:
+        c.paused <- true
+
+        for control := range c.control {
+            switch control {
+            case jobControlCancel:
+                return errJobCancelled
+            case jobControlResume:
+                return nil
+            }
+        }
+    }
+
+    return nil
+}
+
+type recoveryHarness struct {
+    t           *testing.T
+    clock       *recoveryTestClock
+    updates     chan *miio.DeviceUpdateMessage
+    vacuum      *fakeRecoveryVacuum
+    control     *fakeRecoveryControl
+    transitions chan RecoveryTransition
+    done        chan recoveryState
+}
+
+var recoveryTestIdlePoint = Coordinates{25000, 26000}
+
+func startRecovery(t *testing.T, strategy RecoveryStrategy) *recoveryHarness {
+    h := &recoveryHarness{
+        t: t,
+        clock: &recoveryTestClock{Mock: clock.NewMock(), timers: make(chan time.Duration, 10)},
+        updates: make(chan *miio.DeviceUpdateMessage),
+        vacuum: &fakeRecoveryVacuum{commands: make(chan string, 10)},
+        control: &fakeRecoveryControl{control: make(chan jobControl), paused: make(chan bool, 1)},
+        transitions: make(chan RecoveryTransition, 20),
+        done: make(chan recoveryState, 1),
+    }
+
+    recovery := newDockRecovery(h.vacuum, h.updates, h.clock, h.control, strategy, recoveryTestIdlePoint)
+    recovery.OnTransition = func(transition RecoveryTransition) {
+        h.transitions <- transition
+    }
+
+    go func() {
+        h.done <- recovery.Run()
+    }()
+
+    h.expectTransition(recoveryStateSettling)
+    h.expectTimer(defaultRecoveryTimeouts[recoveryStateSettling])
+
+    return h
+}
+
+func (h *recoveryHarness) send(state miio.VacState) {
+    h.t.Helper()
+
+    select {
+    case h.updates <- &miio.DeviceUpdateMessage{State: &miio.VacuumState{State: state}}:
+    case <-time.After(recoveryTestWait):
+        h.t.Fatalf("FSM did not read state %d", state)
+    }
+}
+
+func (h *recoveryHarness) sendControl(control jobControl) {
+    h.t.Helper()
+
+    select {
+    case h.control.control <- control:
+    case <-time.After(recoveryTestWait):
+        h.t.Fatalf("FSM did not read control %d", control)
+    }
+}
+
+func (h *recoveryHarness) pause() {
+    h.t.Helper()
+
+    h.sendControl(jobControlPause)
+
+    select {
+    case <-h.control.paused:
+    case <-time.After(recoveryTestWait):
+        h.t.Fatal("FSM did not pause")
+    }
+}
+
+func (h *recoveryHarness) advance(d time.Duration) {
+    h.clock.Add(d)
+}
+
+func (h *recoveryHarness) expectTransition(state recoveryState) RecoveryTransition {
+    h.t.Helper()
+
+    select {
+    case transition := <-h.transitions:
+        if transition.To != state {
+            h.t.Fatalf("Expected transition to %s, got %s (%s)", state, transition.To, transition.Reason)
+        }
+
+        return transition
+    case <-time.After(recoveryTestWait):
+        h.t.Fatalf("No transition to %s", state)
+    }
+
+    return RecoveryTransition{}
+}
+
+func (h *recoveryHarness) expectStep(step int) {
+    h.t.Helper()
+
+    if transition := h.expectTransition(recoveryStateRecovering); transition.Step != step {
+        h.t.Fatalf("Expected step %d, got %d", step, transition.Step)
+    }
+}
+
+func (h *recoveryHarness) expectTimer(d time.Duration) {
+    h.t.Helper()
+
+    select {
+    case timeout := <-h.clock.timers:
+        if timeout != d {
+            h.t.Fatalf("Expected timer of %s, got %s", d, timeout)
+        }
+    case <-time.After(recoveryTestWait):
+        h.t.Fatalf("No timer of %s started", d)
+    }
+}
+
+func (h *recoveryHarness) expectCommand(command string) {
+    h.t.Helper()
+
+    select {
+    case sent := <-h.vacuum.commands:
+        if sent != command {
+            h.t.Fatalf("Expected command %s, got %s", command, sent)
+        }
+    case <-time.After(recoveryTestWait):
+        h.t.Fatalf("Command %s not sent", command)
+    }
+}
+
+func (h *recoveryHarness) expectNoCommand() {
+    h.t.Helper()
+
+    select {
+    case sent := <-h.vacuum.commands:
+        h.t.Fatalf("Unexpected command %s", sent)
+    default:
+    }
+}
+
+func (h *recoveryHarness) expectDone(state recoveryState) {
+    h.t.Helper()
+
+    h.expectTransition(state)
+
+    select {
+    case result := <-h.done:
+        if result != state {
+            h.t.Fatalf("Run returned %s, expected %s", result, state)
+        }
+    case <-time.After(recoveryTestWait):
+        h.t.Fatal("Run did not return")
+    }
+}
+
+// Settles and reaches the cleaning state.
+func (h *recoveryHarness) settle() {
+    h.t.Helper()
+
+    h.send(miio.VacStateZoneClean)
+    h.advance(defaultRecoveryTimeouts[recoveryStateSettling])
+    h.expectTransition(recoveryStateCleaning)
+    h.expectTimer(defaultRecoveryTimeouts[recoveryStateCleaning])
+}
+
+var recoveryTestStrategy = RecoveryStrategy{
+    Name: "test",
+    Steps: []RecoveryStep{
+        {Action: recoveryActionGoto, Until: "idle", Timeout: 300},
+        {Action: recoveryActionWait, Timeout: 60},
+        {Action: recoveryActionDock, Until: "idle", Timeout: 600},
+    },
+}
+
+func TestRecoveryReturnsToDock(t *testing.T) {
+    h := startRecovery(t, recoveryTestStrategy)
+    h.settle()
+
+    h.send(miio.VacStateReturning)
+    h.expectTransition(recoveryStateReturning)
+    h.expectTimer(defaultRecoveryTimeouts[recoveryStateReturning])
+
+    h.send(miio.VacStateCharging)
+    h.expectDone(recoveryStateDocked)
+    h.expectNoCommand()
+}
+
+func TestRecoverySettlingIgnoresStates(t *testing.T) {
+    h := startRecovery(t, recoveryTestStrategy)
+
+    // The zoned clean has not started yet
+    h.send(miio.VacStateCharging)
+    h.send(miio.VacStateIdle)
+
+    h.advance(defaultRecoveryTimeouts[recoveryStateSettling])
+    h.expectTransition(recoveryStateCleaning)
+    h.expectTimer(defaultRecoveryTimeouts[recoveryStateCleaning])
+
+    // The last state seen while settling gets evaluated afterwards
+    h.expectStep(0)
+    h.expectTimer(300 * time.Second)
+    h.expectCommand("goto 25000 26000")
+}
+
+func TestRecoveryRunsStrategySteps(t *testing.T) {
+    h := startRecovery(t, recoveryTestStrategy)
+    h.settle()
+
+    h.send(miio.VacStateReturning)
+    h.expectTransition(recoveryStateReturning)
+    h.expectTimer(defaultRecoveryTimeouts[recoveryStateReturning])
+
+    // Dock not found
+    h.send(miio.VacStateIdle)
+    h.expectStep(0)
+    h.expectTimer(300 * time.Second)
+    h.expectCommand("goto 25000 26000")
+
+    // Still idle, the robot has to leave the state first
+    h.send(miio.VacStateIdle)
+    h.send(miio.VacStateGoTo)
+    h.send(miio.VacStateIdle)
+    h.expectStep(1)
+    h.expectTimer(60 * time.Second)
+    h.expectNoCommand()
+
+    h.advance(60 * time.Second)
+    h.expectStep(2)
+    h.expectTimer(600 * time.Second)
+    h.expectCommand("dock")
+
+    h.send(miio.VacStateCharging)
+    h.expectDone(recoveryStateDocked)
+}
+
+func TestRecoveryStepPoint(t *testing.T) {
+    h := startRecovery(t, RecoveryStrategy{
+        Name: "point",
+        Steps: []RecoveryStep{
+            {Action: recoveryActionVolume, Volume: 30},
+            {Action: recoveryActionGoto, Point: Coordinates{1000, 2000}, Until: "idle", Timeout: 10},
+        },
+    })
+    h.settle()
+
+    h.send(miio.VacStateIdle)
+    h.expectStep(0)
+    h.expectTimer(0)
+    h.expectCommand("volume 30")
+
+    // Steps without a timeout are done right away
+    h.advance(0)
+    h.expectStep(1)
+    h.expectTimer(10 * time.Second)
+    h.expectCommand("goto 1000 2000")
+}
+
+func TestRecoveryStateTimeouts(t *testing.T) {
+    t.Run("cleaning", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.advance(defaultRecoveryTimeouts[recoveryStateCleaning] - time.Second)
+        h.expectNoCommand()
+
+        h.advance(time.Second)
+        h.expectDone(recoveryStateFailed)
+    })
+
+    t.Run("returning", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.send(miio.VacStateReturning)
+        h.expectTransition(recoveryStateReturning)
+        h.expectTimer(defaultRecoveryTimeouts[recoveryStateReturning])
+
+        h.advance(defaultRecoveryTimeouts[recoveryStateReturning])
+        h.expectDone(recoveryStateFailed)
+    })
+}
+
+func TestRecoveryStepTimeouts(t *testing.T) {
+    h := startRecovery(t, recoveryTestStrategy)
+    h.settle()
+
+    h.send(miio.VacStateIdle)
+    h.expectStep(0)
+    h.expectTimer(300 * time.Second)
+    h.expectCommand("goto 25000 26000")
+
+    h.advance(300 * time.Second)
+    h.expectStep(1)
+    h.expectTimer(60 * time.Second)
+
+    h.advance(60 * time.Second)
+    h.expectStep(2)
+    h.expectTimer(600 * time.Second)
+    h.expectCommand("dock")
+
+    // No steps left
+    h.advance(600 * time.Second)
+    h.expectDone(recoveryStateFailed)
+}
+
+func TestRecoveryPauseFreezesDeadline(t *testing.T) {
+    t.Run("returning", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.send(miio.VacStateReturning)
+        h.expectTransition(recoveryStateReturning)
+        h.expectTimer(10 * time.Minute)
+
+        h.advance(4 * time.Minute)
+        h.pause()
+
+        // Paused time does not count
+        h.advance(time.Hour)
+        h.sendControl(jobControlResume)
+        h.expectTimer(6 * time.Minute)
+        h.expectCommand("dock")
+
+        h.advance(6 * time.Minute)
+        h.expectDone(recoveryStateFailed)
+    })
+
+    t.Run("recovering", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.send(miio.VacStateIdle)
+        h.expectStep(0)
+        h.expectTimer(300 * time.Second)
+        h.expectCommand("goto 25000 26000")
+
+        h.advance(100 * time.Second)
+        h.pause()
+        h.advance(time.Hour)
+        h.sendControl(jobControlResume)
+        h.expectTimer(200 * time.Second)
+        h.expectCommand("goto 25000 26000")
+
+        // The robot has to leave idle again after the command got re-issued
+        h.send(miio.VacStateIdle)
+        h.send(miio.VacStateGoTo)
+        h.send(miio.VacStateIdle)
+        h.expectStep(1)
+        h.expectTimer(60 * time.Second)
+    })
+
+    t.Run("cleaning", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.advance(time.Hour)
+        h.pause()
+        h.sendControl(jobControlResume)
+        h.expectTimer(3 * time.Hour)
+
+        // The zoned clean is re-issued by the job, not the recovery
+        h.expectNoCommand()
+    })
+}
+
+func TestRecoveryCancel(t *testing.T) {
+    t.Run("running", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.sendControl(jobControlCancel)
+        h.expectDone(recoveryStateCancelled)
+    })
+
+    t.Run("paused", func(t *testing.T) {
+        h := startRecovery(t, recoveryTestStrategy)
+        h.settle()
+
+        h.send(miio.VacStateIdle)
+        h.expectStep(0)
+        h.expectTimer(300 * time.Second)
+        h.expectCommand("goto 25000 26000")
+
+        h.pause()
+        h.sendControl(jobControlCancel)
+        h.expectDone(recoveryStateCancelled)
+        h.expectNoCommand()
+    })
+}
+
+func TestRecoveryUpdateChannelClosed(t *testing.T) {
+    h := startRecovery(t, recoveryTestStrategy)
+    h.settle()
+
+    close(h.updates)
+    h.expectDone(recoveryStateFailed)
+}
+
+func TestRecoveryStateJSON(t *testing.T) {
+    for state := range recoveryStateNames {
+        data, err := json.Marshal(state)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        var decoded recoveryState
+        if err := json.Unmarshal(data, &decoded); err != nil {
+            t.Fatal(err)
+        }
+
+        if decoded != state {
+            t.Fatalf("%s decoded as %s", data, decoded)
+        }
+    }
+
+    var decoded recoveryState
+    if err := json.Unmarshal([]byte(`"unknown"`), &decoded); err == nil {
+        t.Fatal("Unknown state accepted")
+    }
+}
+
+func TestRecoveryStepValidate(t *testing.T) {
+    invalid := []RecoveryStep{
+        {Action: recoveryActionGoto},
+        {Action: recoveryActionDock, Until: "idle"},
+        {Action: recoveryActionWait},
+        {Action: recoveryActionFindMe, Until: "idle"},
+        {Action: recoveryActionGoto, Point: Coordinates{1}, Timeout: 10},
+        {Action: "fly", Timeout: 10},
+    }
+
+    for _, step := range invalid {
+        if step.Validate() == nil {
+            t.Errorf("Step %+v accepted", step)
+        }
+    }
+
+    if err := builtinRecoveryStrategy.Validate(); err != nil {
+        t.Errorf("Built-in strategy rejected: %s", err.Error())
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "errors"
+    "image/color"
+
+    "github.com/novag/gen1_room_controller/rrmap"
+)
+
+const (
+    mapRenderPNGTopic = "devices/vacuum/%s/map/render/png"
+    mapRenderSVGTopic = "devices/vacuum/%s/map/render/svg"
+
+    mapRenderScale = 2
+)
+
+// Colors the rooms get assigned in order
+var roomOverlayColors = []color.RGBA{
+    {0xe6, 0x19, 0x4b, 0xff},
+    {0x3c, 0xb4, 0x4b, 0xff},
+    {0x43, 0x63, 0xd8, 0xff},
+    {0xf5, 0x82, 0x31, 0xff},
+    {0x91, 0x1e, 0xb4, 0xff},
+    {0x46, 0xf0, 0xf0, 0xff},
+    {0xf0, 0x32, 0xe6, 0xff},
+    {0x80, 0x80, 0x00, 0xff},
+}
+
+func roomOverlay(room Room, c color.RGBA) rrmap.Overlay {
+    overlay := rrmap.Overlay{
+        Label: room.Name,
+        Color: c,
+    }
+
+    for _, zone := range room.Zones {
+        overlay.Rects = append(overlay.Rects, rrmap.Rect{X1: zone.X1, Y1: zone.Y1, X2: zone.X2, Y2: zone.Y2})
+    }
+
+    if len(room.IdlePoint) == 2 {
+        overlay.Points = append(overlay.Points, rrmap.Point{X: room.IdlePoint[0], Y: room.IdlePoint[1]})
+    }
+
+    return overlay
+}
+
+// mapRenderer prepares the live map with the rooms of the active profile.
+func mapRenderer() (*rrmap.Renderer, error) {
+    m, err := rrmap.ReadFile(rockroboBasePath + "last_map")
+    if err != nil {
+        return nil, err
+    }
+
+    geometry := readMapGeometry(rockroboBasePath)
+
+    renderer := &rrmap.Renderer{
+        Map: m,
+        Dock: geometry.Dock,
+        Start: geometry.Start,
+        Scale: mapRenderScale,
+    }
+
+    for index, room := range listRooms() {
+        renderer.Overlays = append(renderer.Overlays,
+            roomOverlay(room, roomOverlayColors[index % len(roomOverlayColors)]))
+    }
+
+    return renderer, nil
+}
+
+// renderMap publishes the map in the given format, png or svg.
+func renderMap(format string) error {
+    renderer, err := mapRenderer()
+    if err != nil {
+        return err
+    }
+
+    switch format {
+    case "", "png":
+        data, err := renderer.PNG()
+        if err != nil {
+            return err
+        }
+
+        publish(mapRenderPNGTopic, false, data)
+    case "svg":
+        publish(mapRenderSVGTopic, false, renderer.SVG())
+    default:
+        return errors.New("Unknown render format " + format + "!")
+    }
+
+    return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+)
+
+// CleanRoomRequest is the payload of clean_room. It either carries the room
+// inline or references a stored room by name.
+type CleanRoomRequest struct {
+    Room
+    JobLimits
+    RoomName    string  `json:"room,omitempty"`
+    // Overrides the repeat count of every zone
+    Repeat      int     `json:"repeat,omitempty"`
+}
+
+var roomsMutex sync.Mutex
+var rooms = map[string]Room{}
+// Catalogue of the active profile
+var roomsPath string
+
+func loadRooms(path string) error {
+    stored := map[string]Room{}
+
+    if err := ReadJSONFile(path, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    roomsMutex.Lock()
+    rooms = stored
+    roomsPath = path
+    roomsMutex.Unlock()
+
+    return nil
+}
+
+func getRoom(name string) (Room, error) {
+    roomsMutex.Lock()
+    defer roomsMutex.Unlock()
+
+    room, ok := rooms[name]
+    if !ok {
+        return Room{}, errors.New("Unknown room " + name + "!")
+    }
+
+    return room, nil
+}
+
+func listRooms() []Room {
+    roomsMutex.Lock()
+    defer roomsMutex.Unlock()
+
+    list := make([]Room, 0, len(rooms))
+    for _, room := range rooms {
+        list = append(list, room)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+func setRoom(room Room) error {
+    if room.Name == "" {
+        return errors.New("Room without name!")
+    }
+
+    if err := room.Validate(); err != nil {
+        return err
+    }
+
+    roomsMutex.Lock()
+    defer roomsMutex.Unlock()
+
+    previous, existed := rooms[room.Name]
+    rooms[room.Name] = room
+
+    if err := WriteJSONFile(roomsPath, rooms); err != nil {
+        if existed {
+            rooms[room.Name] = previous
+        } else {
+            delete(rooms, room.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteRoom(name string) error {
+    roomsMutex.Lock()
+    defer roomsMutex.Unlock()
+
+    room, ok := rooms[name]
+    if !ok {
+        return errors.New("Unknown room " + name + "!")
+    }
+
+    delete(rooms, name)
+    if err := WriteJSONFile(roomsPath, rooms); err != nil {
+        rooms[name] = room
+        return err
+    }
+
+    return nil
+}
+
+// resolve returns the room to clean with the request's overrides applied.
+func (request CleanRoomRequest) resolve() (Room, error) {
+    room := request.Room
+
+    if request.RoomName != "" {
+        stored, err := getRoom(request.RoomName)
+        if err != nil {
+            return room, err
+        }
+
+        if request.FanPower != 0 {
+            stored.FanPower = request.FanPower
+        }
+
+        if request.Strategy != "" {
+            stored.Strategy = request.Strategy
+        }
+
+        room = stored
+    }
+
+    if request.Repeat != 0 {
+        if request.Repeat < 1 || request.Repeat > maxZoneRepeats {
+            return room, fmt.Errorf("Repeat count %d is not between 1 and %d!", request.Repeat, maxZoneRepeats)
+        }
+
+        zones := make(RoomZones, len(room.Zones))
+        for index, zone := range room.Zones {
+            zone.Repeats = request.Repeat
+            zones[index] = zone
+        }
+        room.Zones = zones
+    }
+
+    return room, nil
+}
+
+func resolveRooms(requests []CleanRoomRequest) ([]Room, error) {
+    resolved := make([]Room, len(requests))
+
+    for index, request := range requests {
+        room, err := request.resolve()
+        if err != nil {
+            return nil, err
+        }
+
+        resolved[index] = room
+    }
+
+    return resolved, nil
+}
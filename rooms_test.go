@@ -0,0 +1,50 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+)
+
+func TestSetRoomRollback(t *testing.T) {
+    directory, err := ioutil.TempDir("", "rooms")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(directory)
+
+    previousRooms, previousPath := rooms, roomsPath
+    defer func() {
+        rooms, roomsPath = previousRooms, previousPath
+    }()
+
+    kitchen := Room{Name: "kitchen", Zones: RoomZones{{100, 200, 300, 400, 1}}, IdlePoint: Coordinates{25000, 25000}}
+    rooms = map[string]Room{kitchen.Name: kitchen}
+    roomsPath = directory + "/rooms.json"
+
+    if err := setRoom(Room{Name: "hall", Zones: RoomZones{{500, 500, 900, 900, 1}}, IdlePoint: Coordinates{25000, 25000}}); err != nil {
+        t.Fatal(err)
+    }
+
+    // The file is in the way of the directory
+    roomsPath += "/rooms.json"
+
+    changed := kitchen
+    changed.FanPower = 90
+    if setRoom(changed) == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if setRoom(Room{Name: "bath", Zones: RoomZones{{0, 0, 100, 100, 1}}, IdlePoint: Coordinates{25000, 25000}}) == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if deleteRoom("hall") == nil {
+        t.Fatal("Write error not reported")
+    }
+
+    if list := listRooms(); len(list) != 2 || !reflect.DeepEqual(list[1], kitchen) {
+        t.Fatalf("Rooms %+v after failed writes", list)
+    }
+}
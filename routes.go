@@ -0,0 +1,252 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const (
+    maxRouteWait = 3600
+    maxRouteRepeats = 100
+)
+
+// Waypoint is either a named location or a point in robot coordinates.
+type Waypoint struct {
+    Location    string          `json:"location,omitempty"`
+    Point       Coordinates     `json:"point,omitempty"`
+}
+
+// Route is driven point by point, optionally several times.
+type Route struct {
+    Name        string      `json:"name"`
+    Waypoints   []Waypoint  `json:"waypoints"`
+    // Seconds to wait at every waypoint
+    Wait        int         `json:"wait"`
+    // Additional rounds after the first one
+    Repeat      int         `json:"repeat"`
+    Dock        bool        `json:"dock"`
+}
+
+type RouteProgress struct {
+    Route       string          `json:"route"`
+    Round       int             `json:"round"`
+    Rounds      int             `json:"rounds"`
+    Leg         int             `json:"leg"`
+    Legs        int             `json:"legs"`
+    Location    string          `json:"location,omitempty"`
+    Point       Coordinates     `json:"point"`
+}
+
+var routesMutex sync.Mutex
+var routes = map[string]Route{}
+// Routes of the active profile
+var routesPath string
+
+func (waypoint Waypoint) resolve() (Coordinates, error) {
+    if waypoint.Location != "" {
+        location, err := getLocation(waypoint.Location)
+        if err != nil {
+            return nil, err
+        }
+
+        return location.Point, nil
+    }
+
+    if err := validatePoint(waypoint.Point); err != nil {
+        return nil, err
+    }
+
+    return waypoint.Point, nil
+}
+
+func (route Route) Validate() error {
+    if route.Name == "" {
+        return errors.New("Route without name!")
+    }
+
+    if len(route.Waypoints) == 0 {
+        return errors.New("Route " + route.Name + " has no waypoints!")
+    }
+
+    for index, waypoint := range route.Waypoints {
+        if (waypoint.Location == "") == (waypoint.Point == nil) {
+            return fmt.Errorf("Waypoint %d needs either a location or a point!", index)
+        }
+
+        if waypoint.Point != nil {
+            if err := validatePoint(waypoint.Point); err != nil {
+                return fmt.Errorf("Waypoint %d: %s", index, err.Error())
+            }
+        }
+    }
+
+    if route.Wait < 0 || route.Wait > maxRouteWait {
+        return fmt.Errorf("Wait time must be between 0 and %d seconds!", maxRouteWait)
+    }
+
+    if route.Repeat < 0 || route.Repeat > maxRouteRepeats {
+        return fmt.Errorf("Repeat count must be between 0 and %d!", maxRouteRepeats)
+    }
+
+    return nil
+}
+
+func loadRoutes(path string) error {
+    stored := map[string]Route{}
+
+    if err := ReadJSONFile(path, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    routesMutex.Lock()
+    routes = stored
+    routesPath = path
+    routesMutex.Unlock()
+
+    return nil
+}
+
+func getRoute(name string) (Route, error) {
+    routesMutex.Lock()
+    defer routesMutex.Unlock()
+
+    route, ok := routes[name]
+    if !ok {
+        return Route{}, errors.New("Unknown route " + name + "!")
+    }
+
+    return route, nil
+}
+
+func listRoutes() []Route {
+    routesMutex.Lock()
+    defer routesMutex.Unlock()
+
+    list := make([]Route, 0, len(routes))
+    for _, route := range routes {
+        list = append(list, route)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Name < list[j].Name
+    })
+
+    return list
+}
+
+func setRoute(route Route) error {
+    if err := route.Validate(); err != nil {
+        return err
+    }
+
+    routesMutex.Lock()
+    defer routesMutex.Unlock()
+
+    previous, existed := routes[route.Name]
+    routes[route.Name] = route
+
+    if err := WriteJSONFile(routesPath, routes); err != nil {
+        if existed {
+            routes[route.Name] = previous
+        } else {
+            delete(routes, route.Name)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteRoute(name string) error {
+    routesMutex.Lock()
+    defer routesMutex.Unlock()
+
+    route, ok := routes[name]
+    if !ok {
+        return errors.New("Unknown route " + name + "!")
+    }
+
+    delete(routes, name)
+    if err := WriteJSONFile(routesPath, routes); err != nil {
+        routes[name] = route
+        return err
+    }
+
+    return nil
+}
+
+// waitDocked sends the robot home and waits for it to charge.
+func waitDocked(job *Job) error {
+    job.OnResume = func() {
+        Vacuum.Dock()
+    }
+
+    Vacuum.Dock()
+
+    return job.waitForState(func(state miio.VacState) bool {
+        return state == miio.VacStateCharging || state == miio.VacStateFullyCharged
+    }, defaultRecoveryTimeouts[recoveryStateReturning])
+}
+
+// runRoute drives a route as a job.
+func runRoute(name string) (*Job, error) {
+    route, err := getRoute(name)
+    if err != nil {
+        return nil, err
+    }
+
+    // Locations may have changed since the route was stored
+    targets := make([]Coordinates, len(route.Waypoints))
+    for index, waypoint := range route.Waypoints {
+        if targets[index], err = waypoint.resolve(); err != nil {
+            return nil, fmt.Errorf("Waypoint %d: %s", index, err.Error())
+        }
+
+        if err := checkNoGo(targets[index][0], targets[index][1]); err != nil {
+            return nil, fmt.Errorf("Waypoint %d: %s", index, err.Error())
+        }
+    }
+
+    return Jobs.Start("patrol", JobLimits{}, func(job *Job) error {
+        rounds := route.Repeat + 1
+
+        for round := 0; round < rounds; round++ {
+            for leg, target := range targets {
+                if err := job.poll(); err != nil {
+                    return err
+                }
+
+                if err := driveTo(job, target); err != nil {
+                    return err
+                }
+
+                job.publishProgress(RouteProgress{
+                    Route: route.Name,
+                    Round: round,
+                    Rounds: rounds,
+                    Leg: leg,
+                    Legs: len(targets),
+                    Location: route.Waypoints[leg].Location,
+                    Point: target,
+                })
+
+                if err := job.sleep(time.Duration(route.Wait) * time.Second); err != nil {
+                    return err
+                }
+            }
+        }
+
+        if route.Dock {
+            return waitDocked(job)
+        }
+
+        return nil
+    })
+}
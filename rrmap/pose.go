@@ -0,0 +1,102 @@
+package rrmap
+
+import (
+    "errors"
+    "io/ioutil"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Robot coordinates of the SLAM origin (mm)
+const slamOrigin = Size * Resolution / 2
+
+// Pose is a position in robot coordinates (mm) with an optional heading in
+// degrees, as stored in ChargerPos.data and StartPos.data.
+type Pose struct {
+    X       int         `json:"x"`
+    Y       int         `json:"y"`
+    Angle   *float64    `json:"angle,omitempty"`
+}
+
+// ParsePose reads the position files. Depending on the firmware they hold
+// whitespace or comma separated numbers, either robot coordinates in mm or
+// SLAM coordinates in metres, or two to three little endian int32 values.
+func ParsePose(data []byte) (*Pose, error) {
+    text := strings.TrimSpace(string(data))
+    if text == "" {
+        return nil, errors.New("Empty position file!")
+    }
+
+    fields := strings.FieldsFunc(text, func(r rune) bool {
+        return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ',' || r == ';' ||
+            r == '[' || r == ']'
+    })
+
+    values := make([]float64, 0, len(fields))
+    metres := false
+    for _, field := range fields {
+        value, err := strconv.ParseFloat(field, 64)
+        if err != nil {
+            return parseBinaryPose(data)
+        }
+
+        if strings.Contains(field, ".") {
+            metres = true
+        }
+
+        values = append(values, value)
+    }
+
+    if len(values) < 2 || len(values) > 3 {
+        return nil, errors.New("Invalid position " + text + "!")
+    }
+
+    pose := &Pose{}
+    if metres && math.Abs(values[0]) < slamOrigin / 1000 && math.Abs(values[1]) < slamOrigin / 1000 {
+        pose.X = slamOrigin + int(math.Round(values[0] * 1000))
+        pose.Y = slamOrigin + int(math.Round(values[1] * 1000))
+    } else {
+        pose.X = int(math.Round(values[0]))
+        pose.Y = int(math.Round(values[1]))
+    }
+
+    if len(values) == 3 {
+        pose.Angle = &values[2]
+    }
+
+    return pose, nil
+}
+
+func parseBinaryPose(data []byte) (*Pose, error) {
+    if len(data) != 8 && len(data) != 12 {
+        return nil, errors.New("Unknown position format!")
+    }
+
+    pose := &Pose{
+        X: int(readInt32(data)),
+        Y: int(readInt32(data[4:])),
+    }
+
+    if len(data) == 12 {
+        angle := float64(readInt32(data[8:]))
+        pose.Angle = &angle
+    }
+
+    return pose, nil
+}
+
+// ReadPose parses the position file at path.
+func ReadPose(path string) (*Pose, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    return ParsePose(data)
+}
+
+// Distance returns the distance between two poses in mm.
+func (pose *Pose) Distance(other *Pose) float64 {
+    return math.Hypot(float64(pose.X - other.X), float64(pose.Y - other.Y))
+}
@@ -0,0 +1,274 @@
+package rrmap
+
+import (
+    "bytes"
+    "fmt"
+    "html"
+    "image"
+    "image/color"
+    "image/png"
+)
+
+var (
+    colorWall = color.RGBA{0x40, 0x40, 0x40, 0xff}
+    colorFloor = color.RGBA{0xc8, 0xdc, 0xf0, 0xff}
+    colorDock = color.RGBA{0x20, 0xa0, 0x20, 0xff}
+    colorStart = color.RGBA{0xf0, 0x90, 0x00, 0xff}
+    colorRobot = color.RGBA{0xd0, 0x20, 0x20, 0xff}
+)
+
+// Rect is an axis-aligned rectangle in robot coordinates (mm).
+type Rect struct {
+    X1  int
+    Y1  int
+    X2  int
+    Y2  int
+}
+
+// Overlay is drawn on top of the map, e.g. the zones of a room.
+type Overlay struct {
+    Label   string
+    Rects   []Rect
+    Points  []Point
+    Color   color.RGBA
+}
+
+// Renderer draws a map with its dock, start position and overlays. Rows of
+// the map image are flipped so that y points up like in the vendor app.
+type Renderer struct {
+    Map         *Map
+    Dock        *Pose
+    Start       *Pose
+    Overlays    []Overlay
+    // Output pixels per map pixel
+    Scale       int
+}
+
+func (r *Renderer) scale() int {
+    if r.Scale < 1 {
+        return 1
+    }
+
+    return r.Scale
+}
+
+// project converts robot coordinates to (unscaled) output coordinates.
+func (r *Renderer) project(x int, y int) (float64, float64) {
+    img := r.Map.Image
+
+    return float64(x) / Resolution - float64(img.Left),
+        float64(img.Height) - (float64(y) / Resolution - float64(img.Top))
+}
+
+func (r *Renderer) cellColor(x int, y int) (color.RGBA, bool) {
+    switch r.Map.Image.Cell(x, r.Map.Image.Height - 1 - y) {
+    case CellWall:
+        return colorWall, true
+    case CellFloor:
+        return colorFloor, true
+    }
+
+    return color.RGBA{}, false
+}
+
+// PNG renders the map as PNG image.
+func (r *Renderer) PNG() ([]byte, error) {
+    img := r.Map.Image
+    scale := r.scale()
+    out := image.NewRGBA(image.Rect(0, 0, img.Width * scale, img.Height * scale))
+
+    for y := 0; y < img.Height; y++ {
+        for x := 0; x < img.Width; x++ {
+            if c, ok := r.cellColor(x, y); ok {
+                fillRect(out, x * scale, y * scale, (x + 1) * scale, (y + 1) * scale, c)
+            }
+        }
+    }
+
+    for _, overlay := range r.Overlays {
+        fill := overlay.Color
+        fill.A = 0x50
+
+        for _, rect := range overlay.Rects {
+            x1, y1 := r.project(rect.X1, rect.Y2)
+            x2, y2 := r.project(rect.X2, rect.Y1)
+
+            blendRect(out, int(x1) * scale, int(y1) * scale, int(x2) * scale, int(y2) * scale, fill)
+            strokeRect(out, int(x1) * scale, int(y1) * scale, int(x2) * scale, int(y2) * scale, overlay.Color)
+        }
+
+        for _, point := range overlay.Points {
+            x, y := r.project(point.X, point.Y)
+            drawCross(out, int(x * float64(scale)), int(y * float64(scale)), 3 * scale, overlay.Color)
+        }
+    }
+
+    for _, marker := range r.markers() {
+        x, y := r.project(marker.pose.X, marker.pose.Y)
+        drawDisc(out, int(x * float64(scale)), int(y * float64(scale)), 2 * scale, marker.color)
+    }
+
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, out); err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
+
+// SVG renders the map as SVG document. Overlays are labelled.
+func (r *Renderer) SVG() []byte {
+    img := r.Map.Image
+    scale := r.scale()
+
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+        img.Width * scale, img.Height * scale, img.Width, img.Height)
+    buf.WriteString("\n")
+
+    // One rect per run of equal cells
+    for y := 0; y < img.Height; y++ {
+        for x := 0; x < img.Width; {
+            c, ok := r.cellColor(x, y)
+
+            end := x + 1
+            for end < img.Width {
+                next, nextOk := r.cellColor(end, y)
+                if next != c || nextOk != ok {
+                    break
+                }
+                end++
+            }
+
+            if ok {
+                fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%d" height="1" fill="%s"/>`, x, y, end - x, hexColor(c))
+                buf.WriteString("\n")
+            }
+
+            x = end
+        }
+    }
+
+    for _, overlay := range r.Overlays {
+        fmt.Fprintf(&buf, `<g stroke="%s" fill="%s" fill-opacity="0.3" stroke-width="0.5">`, hexColor(overlay.Color), hexColor(overlay.Color))
+        buf.WriteString("\n")
+
+        for index, rect := range overlay.Rects {
+            x1, y1 := r.project(rect.X1, rect.Y2)
+            x2, y2 := r.project(rect.X2, rect.Y1)
+
+            fmt.Fprintf(&buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f"/>`, x1, y1, x2 - x1, y2 - y1)
+            if index == 0 && overlay.Label != "" {
+                fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" font-size="6" stroke="none" fill-opacity="1">%s</text>`,
+                    x1 + 1, y1 + 6, html.EscapeString(overlay.Label))
+            }
+            buf.WriteString("\n")
+        }
+
+        for _, point := range overlay.Points {
+            x, y := r.project(point.X, point.Y)
+
+            fmt.Fprintf(&buf, `<path d="M%.1f %.1fl6 6M%.1f %.1fl-6 6"/>`, x - 3, y - 3, x + 3, y - 3)
+            buf.WriteString("\n")
+        }
+
+        buf.WriteString("</g>\n")
+    }
+
+    for _, marker := range r.markers() {
+        x, y := r.project(marker.pose.X, marker.pose.Y)
+
+        fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"><title>%s</title></circle>`, x, y, hexColor(marker.color), marker.name)
+        buf.WriteString("\n")
+    }
+
+    buf.WriteString("</svg>\n")
+
+    return buf.Bytes()
+}
+
+type marker struct {
+    name    string
+    pose    Pose
+    color   color.RGBA
+}
+
+func (r *Renderer) markers() []marker {
+    var markers []marker
+
+    if r.Dock != nil {
+        markers = append(markers, marker{"dock", *r.Dock, colorDock})
+    }
+
+    if r.Start != nil {
+        markers = append(markers, marker{"start", *r.Start, colorStart})
+    }
+
+    if r.Map.Robot != nil {
+        markers = append(markers, marker{"robot", Pose{X: r.Map.Robot.X, Y: r.Map.Robot.Y}, colorRobot})
+    }
+
+    return markers
+}
+
+func hexColor(c color.RGBA) string {
+    return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func fillRect(img *image.RGBA, x1 int, y1 int, x2 int, y2 int, c color.RGBA) {
+    for y := y1; y < y2; y++ {
+        for x := x1; x < x2; x++ {
+            img.SetRGBA(x, y, c)
+        }
+    }
+}
+
+func blendRect(img *image.RGBA, x1 int, y1 int, x2 int, y2 int, c color.RGBA) {
+    bounds := img.Bounds()
+    alpha := uint32(c.A)
+
+    for y := y1; y < y2; y++ {
+        for x := x1; x < x2; x++ {
+            if !(image.Point{x, y}.In(bounds)) {
+                continue
+            }
+
+            old := img.RGBAAt(x, y)
+            img.SetRGBA(x, y, color.RGBA{
+                R: uint8((uint32(c.R) * alpha + uint32(old.R) * (255 - alpha)) / 255),
+                G: uint8((uint32(c.G) * alpha + uint32(old.G) * (255 - alpha)) / 255),
+                B: uint8((uint32(c.B) * alpha + uint32(old.B) * (255 - alpha)) / 255),
+                A: 0xff,
+            })
+        }
+    }
+}
+
+func strokeRect(img *image.RGBA, x1 int, y1 int, x2 int, y2 int, c color.RGBA) {
+    for x := x1; x < x2; x++ {
+        img.SetRGBA(x, y1, c)
+        img.SetRGBA(x, y2 - 1, c)
+    }
+
+    for y := y1; y < y2; y++ {
+        img.SetRGBA(x1, y, c)
+        img.SetRGBA(x2 - 1, y, c)
+    }
+}
+
+func drawCross(img *image.RGBA, cx int, cy int, size int, c color.RGBA) {
+    for d := -size; d <= size; d++ {
+        img.SetRGBA(cx + d, cy + d, c)
+        img.SetRGBA(cx + d, cy - d, c)
+    }
+}
+
+func drawDisc(img *image.RGBA, cx int, cy int, radius int, c color.RGBA) {
+    for y := -radius; y <= radius; y++ {
+        for x := -radius; x <= radius; x++ {
+            if x * x + y * y <= radius * radius {
+                img.SetRGBA(cx + x, cy + y, c)
+            }
+        }
+    }
+}
@@ -0,0 +1,226 @@
+// Package rrmap reads the map files of gen1 Roborock/Xiaomi vacuums.
+package rrmap
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+)
+
+// Map block types
+const (
+    blockCharger = 1
+    blockImage = 2
+    blockPath = 3
+    blockRobotPosition = 8
+)
+
+const (
+    // Size of a map pixel in robot coordinates (mm)
+    Resolution = 50
+    // Robot coordinates span 1024x1024 pixels
+    Size = 1024
+)
+
+// Cell classes
+type Cell int
+
+const (
+    CellUnknown Cell = iota
+    CellWall
+    CellFloor
+)
+
+type Header struct {
+    MajorVersion    int
+    MinorVersion    int
+    Index           int
+    Sequence        int
+}
+
+// Point is a position in robot coordinates (mm).
+type Point struct {
+    X   int
+    Y   int
+}
+
+// Image is the occupancy grid. Rows are stored bottom up, pixel (0, 0) is
+// the map pixel (Left, Top).
+type Image struct {
+    Top     int
+    Left    int
+    Width   int
+    Height  int
+    Pixels  []byte
+}
+
+type Map struct {
+    Header  Header
+    Image   *Image
+    Charger *Point
+    Robot   *Point
+    Path    []Point
+}
+
+// Parse decodes a map, gzip compressed or not.
+func Parse(data []byte) (*Map, error) {
+    if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+        reader, err := gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, err
+        }
+
+        if data, err = ioutil.ReadAll(reader); err != nil {
+            return nil, err
+        }
+    }
+
+    if len(data) < 20 || data[0] != 'r' || data[1] != 'r' {
+        return nil, errors.New("Not a map file!")
+    }
+
+    headerLength := int(binary.LittleEndian.Uint16(data[0x02:]))
+    m := &Map{
+        Header: Header{
+            MajorVersion: int(binary.LittleEndian.Uint16(data[0x08:])),
+            MinorVersion: int(binary.LittleEndian.Uint16(data[0x0a:])),
+            Index: int(binary.LittleEndian.Uint32(data[0x0c:])),
+            Sequence: int(binary.LittleEndian.Uint32(data[0x10:])),
+        },
+    }
+
+    for offset := headerLength; offset + 8 <= len(data); {
+        blockType := binary.LittleEndian.Uint16(data[offset:])
+        blockHeaderLength := int(binary.LittleEndian.Uint16(data[offset + 0x02:]))
+        blockLength := int64(binary.LittleEndian.Uint32(data[offset + 0x04:]))
+
+        // int is 32 bits on the robot, the length alone may not fit
+        end := int64(offset) + int64(blockHeaderLength) + blockLength
+        if blockHeaderLength < 8 || end > int64(len(data)) {
+            return nil, fmt.Errorf("Truncated block %d at offset %d!", blockType, offset)
+        }
+
+        block := data[offset:int(end)]
+
+        switch blockType {
+        case blockCharger:
+            if len(block) >= 16 {
+                m.Charger = &Point{int(readInt32(block[0x08:])), int(readInt32(block[0x0c:]))}
+            }
+        case blockRobotPosition:
+            if len(block) >= 16 {
+                m.Robot = &Point{int(readInt32(block[0x08:])), int(readInt32(block[0x0c:]))}
+            }
+        case blockImage:
+            image, err := parseImage(block, blockHeaderLength)
+            if err != nil {
+                return nil, err
+            }
+
+            m.Image = image
+        case blockPath:
+            m.Path = parsePath(block, blockHeaderLength)
+        }
+
+        offset = int(end)
+    }
+
+    if m.Image == nil {
+        return nil, errors.New("Map has no image!")
+    }
+
+    return m, nil
+}
+
+// ReadFile parses the map at path.
+func ReadFile(path string) (*Map, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    return Parse(data)
+}
+
+func readInt32(data []byte) int32 {
+    return int32(binary.LittleEndian.Uint32(data))
+}
+
+func parseImage(block []byte, headerLength int) (*Image, error) {
+    // Newer firmware adds the number of segments to the header
+    offset := 0
+    if headerLength > 24 {
+        offset = 4
+    }
+
+    if headerLength < 24 + offset || len(block) < headerLength {
+        return nil, errors.New("Invalid image block!")
+    }
+
+    image := &Image{
+        Top: int(readInt32(block[0x08 + offset:])),
+        Left: int(readInt32(block[0x0c + offset:])),
+        Height: int(readInt32(block[0x10 + offset:])),
+        Width: int(readInt32(block[0x14 + offset:])),
+    }
+
+    size := int64(image.Width) * int64(image.Height)
+    if image.Width < 0 || image.Height < 0 || size > int64(len(block) - headerLength) {
+        return nil, fmt.Errorf("Invalid image size %dx%d!", image.Width, image.Height)
+    }
+
+    image.Pixels = block[headerLength:headerLength + image.Width * image.Height]
+
+    return image, nil
+}
+
+func parsePath(block []byte, headerLength int) []Point {
+    var path []Point
+
+    for offset := headerLength; offset + 4 <= len(block); offset += 4 {
+        path = append(path, Point{
+            X: int(binary.LittleEndian.Uint16(block[offset:])),
+            Y: int(binary.LittleEndian.Uint16(block[offset + 2:])),
+        })
+    }
+
+    return path
+}
+
+// Cell returns the class of the image pixel at column x, row y.
+func (image *Image) Cell(x int, y int) Cell {
+    if x < 0 || y < 0 || x >= image.Width || y >= image.Height {
+        return CellUnknown
+    }
+
+    index := int64(y) * int64(image.Width) + int64(x)
+    if index >= int64(len(image.Pixels)) {
+        return CellUnknown
+    }
+
+    value := image.Pixels[index]
+
+    switch {
+    case value == 0:
+        return CellUnknown
+    case value == 1:
+        return CellWall
+    case value == 255:
+        return CellFloor
+    // Segment ids are stored in the upper bits
+    case value & 0x07 == 0:
+        return CellFloor
+    case value & 0x07 == 1:
+        return CellWall
+    }
+
+    return CellUnknown
+}
+
+// CellAt returns the class of the absolute map pixel (px, py).
+func (image *Image) CellAt(px int, py int) Cell {
+    return image.Cell(px - image.Left, py - image.Top)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    schedulesPath = roomControllerBasePath + "schedules.json"
+
+    // Scheduled runs are skipped below this battery level
+    scheduleMinBattery = 40
+    // Number of upcoming runs that get published
+    scheduleNextRuns = 5
+)
+
+// Schedule starts a room clean whenever its cron expression fires.
+type Schedule struct {
+    ID      string              `json:"id"`
+    Cron    string              `json:"cron"`
+    Job     CleanRoomRequest    `json:"job"`
+    // Runs the recipe instead of the job
+    Recipe  string              `json:"recipe,omitempty"`
+    // Optional window in which the schedule fires
+    Start   *time.Time          `json:"start,omitempty"`
+    Until   *time.Time          `json:"until,omitempty"`
+
+    spec    *CronSpec
+}
+
+type ScheduledRun struct {
+    Schedule    string      `json:"schedule"`
+    Room        string      `json:"room"`
+    Time        time.Time   `json:"time"`
+}
+
+type ScheduleRunResult struct {
+    Schedule    string      `json:"schedule"`
+    Time        time.Time   `json:"time"`
+    Job         string      `json:"job,omitempty"`
+    Error       *string     `json:"error"`
+}
+
+var schedulesMutex sync.Mutex
+var schedules = map[string]*Schedule{}
+
+func (schedule *Schedule) parse() error {
+    if schedule.ID == "" {
+        return errors.New("Schedule without id!")
+    }
+
+    spec, err := ParseCron(schedule.Cron)
+    if err != nil {
+        return err
+    }
+
+    if err := schedule.Job.JobLimits.Validate(); err != nil {
+        return err
+    }
+
+    if schedule.Recipe == "" && schedule.Job.RoomName == "" {
+        if err := schedule.Job.Room.Validate(); err != nil {
+            return err
+        }
+    }
+
+    schedule.spec = spec
+
+    return nil
+}
+
+func (schedule *Schedule) active(t time.Time) bool {
+    return (schedule.Start == nil || !t.Before(*schedule.Start)) &&
+        (schedule.Until == nil || !t.After(*schedule.Until))
+}
+
+func (schedule *Schedule) roomName() string {
+    if schedule.Recipe != "" {
+        return schedule.Recipe
+    }
+
+    if schedule.Job.RoomName != "" {
+        return schedule.Job.RoomName
+    }
+
+    return schedule.Job.Name
+}
+
+func loadSchedules() error {
+    var stored []*Schedule
+
+    if err := ReadJSONFile(schedulesPath, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    loaded := map[string]*Schedule{}
+    for _, schedule := range stored {
+        if err := schedule.parse(); err != nil {
+            fmt.Printf("loadSchedules: %s\n", err.Error())
+            continue
+        }
+
+        loaded[schedule.ID] = schedule
+    }
+
+    schedulesMutex.Lock()
+    schedules = loaded
+    schedulesMutex.Unlock()
+
+    return nil
+}
+
+// Must be called with schedulesMutex held.
+func saveSchedules() error {
+    list := make([]*Schedule, 0, len(schedules))
+    for _, schedule := range schedules {
+        list = append(list, schedule)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].ID < list[j].ID
+    })
+
+    return WriteJSONFile(schedulesPath, list)
+}
+
+func listSchedules() []Schedule {
+    schedulesMutex.Lock()
+    defer schedulesMutex.Unlock()
+
+    list := make([]Schedule, 0, len(schedules))
+    for _, schedule := range schedules {
+        list = append(list, *schedule)
+    }
+
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].ID < list[j].ID
+    })
+
+    return list
+}
+
+func setSchedule(schedule *Schedule) error {
+    if err := schedule.parse(); err != nil {
+        return err
+    }
+
+    schedulesMutex.Lock()
+    defer schedulesMutex.Unlock()
+
+    previous := schedules[schedule.ID]
+    schedules[schedule.ID] = schedule
+
+    if err := saveSchedules(); err != nil {
+        if previous != nil {
+            schedules[schedule.ID] = previous
+        } else {
+            delete(schedules, schedule.ID)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+func deleteSchedule(id string) error {
+    schedulesMutex.Lock()
+    defer schedulesMutex.Unlock()
+
+    schedule, ok := schedules[id]
+    if !ok {
+        return errors.New("Unknown schedule " + id + "!")
+    }
+
+    delete(schedules, id)
+    if err := saveSchedules(); err != nil {
+        schedules[id] = schedule
+        return err
+    }
+
+    return nil
+}
+
+// nextScheduledRuns returns the upcoming runs of all schedules.
+func nextScheduledRuns(now time.Time, count int) []ScheduledRun {
+    var runs []ScheduledRun
+
+    schedulesMutex.Lock()
+    for _, schedule := range schedules {
+        t := now
+        if schedule.Start != nil && schedule.Start.After(t) {
+            t = schedule.Start.Add(-time.Minute)
+        }
+
+        for i := 0; i < count; i++ {
+            if t = schedule.spec.Next(t); t.IsZero() || !schedule.active(t) {
+                break
+            }
+
+            runs = append(runs, ScheduledRun{
+                Schedule: schedule.ID,
+                Room: schedule.roomName(),
+                Time: t,
+            })
+        }
+    }
+    schedulesMutex.Unlock()
+
+    sort.Slice(runs, func(i, j int) bool {
+        return runs[i].Time.Before(runs[j].Time)
+    })
+
+    if len(runs) > count {
+        runs = runs[:count]
+    }
+
+    return runs
+}
+
+func publishNextScheduledRuns() {
+    runs := nextScheduledRuns(time.Now(), scheduleNextRuns)
+    if runs == nil {
+        runs = []ScheduledRun{}
+    }
+
+    publishJSON(schedulesNextTopic, true, runs)
+}
+
+func runSchedule(schedule Schedule, now time.Time) {
+    result := ScheduleRunResult{
+        Schedule: schedule.ID,
+        Time: now,
+    }
+
+    err := checkAvailable()
+    if err == nil {
+        err = checkDocked()
+    }
+
+    if err == nil && Vacuum.GetUpdateMessage().State.Battery < scheduleMinBattery {
+        err = fmt.Errorf("Battery low: %d%%!", Vacuum.GetUpdateMessage().State.Battery)
+    }
+
+    if err == nil && schedule.Recipe != "" {
+        var job *Job
+
+        if job, err = runRecipe(schedule.Recipe); err == nil {
+            result.Job = job.ID
+        }
+    } else if err == nil {
+        var room Room
+        var job *Job
+
+        if room, err = schedule.Job.resolve(); err == nil {
+            if job, err = cleanRoom(room, schedule.Job.JobLimits); err == nil {
+                result.Job = job.ID
+            }
+        }
+    }
+
+    if err != nil {
+        fmt.Printf("Skipping schedule %s: %s\n", schedule.ID, err.Error())
+
+        tmp := err.Error(); result.Error = &tmp
+    }
+
+    publishJSON(schedulesRunTopic, false, result)
+}
+
+func schedulerLoop() {
+    publishNextScheduledRuns()
+
+    for {
+        // Wake up at the start of every minute
+        now := time.Now()
+        time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+        now = time.Now()
+
+        var due []Schedule
+
+        schedulesMutex.Lock()
+        for _, schedule := range schedules {
+            if schedule.spec.Matches(now) && schedule.active(now) {
+                due = append(due, *schedule)
+            }
+        }
+        schedulesMutex.Unlock()
+
+        for _, schedule := range due {
+            runSchedule(schedule, now)
+        }
+
+        if len(due) > 0 {
+            publishNextScheduledRuns()
+        }
+    }
+}
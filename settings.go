@@ -0,0 +1,114 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "sync"
+    "time"
+)
+
+const settingsPath = roomControllerBasePath + "settings.json"
+
+// When the base map gets restored after the robot docked
+const (
+    autoRestoreAlways = "always"
+    // Only after jobs started by the controller, manual cleans keep their map
+    autoRestoreControllerJobs = "controller_jobs"
+    autoRestoreNever = "never"
+)
+
+// Jobs that start from the base map. Only docking after one of them counts
+// for the controller_jobs policy.
+var autoRestoreJobKinds = map[string]bool{
+    "clean_rooms": true,
+    "recipe": true,
+}
+
+// Settings are the tunables persisted by the controller.
+type Settings struct {
+    // Seconds to wait for the robot after rrwatchdoge got reloaded
+    ReadinessTimeout    int     `json:"readiness_timeout"`
+    AutoRestore         string  `json:"auto_restore"`
+    // Seconds after a job finished in which docking still counts as the
+    // end of that job
+    AutoRestoreGrace    int     `json:"auto_restore_grace"`
+}
+
+var settingsMutex sync.Mutex
+var settings = Settings{
+    ReadinessTimeout: 120,
+    AutoRestore: autoRestoreAlways,
+    AutoRestoreGrace: 60,
+}
+
+func (s Settings) Validate() error {
+    if s.ReadinessTimeout < 10 || s.ReadinessTimeout > 600 {
+        return errors.New("Readiness timeout must be between 10 and 600 seconds!")
+    }
+
+    switch s.AutoRestore {
+    case autoRestoreAlways, autoRestoreControllerJobs, autoRestoreNever:
+    default:
+        return errors.New("Unknown auto-restore policy " + s.AutoRestore + "!")
+    }
+
+    if s.AutoRestoreGrace < 0 || s.AutoRestoreGrace > 3600 {
+        return errors.New("Auto-restore grace period must be between 0 and 3600 seconds!")
+    }
+
+    return nil
+}
+
+func loadSettings() error {
+    settingsMutex.Lock()
+    defer settingsMutex.Unlock()
+
+    // Missing fields keep their defaults
+    stored := settings
+    if err := ReadJSONFile(settingsPath, &stored); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    if err := stored.Validate(); err != nil {
+        return err
+    }
+
+    settings = stored
+
+    return nil
+}
+
+func getSettings() Settings {
+    settingsMutex.Lock()
+    defer settingsMutex.Unlock()
+
+    return settings
+}
+
+// updateSettings applies a partial update given as JSON.
+func updateSettings(data []byte) (Settings, error) {
+    settingsMutex.Lock()
+    defer settingsMutex.Unlock()
+
+    updated := settings
+    if err := json.Unmarshal(data, &updated); err != nil {
+        return settings, err
+    }
+
+    if err := updated.Validate(); err != nil {
+        return settings, err
+    }
+
+    if err := WriteJSONFile(settingsPath, updated); err != nil {
+        return settings, err
+    }
+
+    settings = updated
+
+    return settings, nil
+}
+
+func readinessTimeout() time.Duration {
+    return time.Duration(getSettings().ReadinessTimeout) * time.Second
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/novag/gen1_room_controller/miio"
+)
+
+const (
+    recoveryStrategiesPath = roomControllerBasePath + "recovery_strategies.json"
+    recoveryStatsPath = roomControllerBasePath + "recovery_stats.json"
+
+    defaultRecoveryStrategy = "default"
+    // Outcomes kept per strategy
+    recoveryOutcomeHistory = 10
+)
+
+// Step actions
+const (
+    recoveryActionGoto = "goto"
+    recoveryActionDock = "dock"
+    recoveryActionVolume = "volume"
+    recoveryActionWait = "wait"
+    recoveryActionFindMe = "find_me"
+)
+
+// Success conditions of a step. The step is done once the robot enters the
+// state after having left it. Charging always ends the recovery, steps
+// without a condition run until their timeout.
+var recoveryConditionStates = map[string]miio.VacState{
+    "idle": miio.VacStateIdle,
+    "returning": miio.VacStateReturning,
+    "goto": miio.VacStateGoTo,
+}
+
+type RecoveryStep struct {
+    Action  string      `json:"action"`
+    // goto only, defaults to the room's idle point
+    Point   Coordinates `json:"point,omitempty"`
+    // volume only
+    Volume  int         `json:"volume,omitempty"`
+    Until   string      `json:"until,omitempty"`
+    // Seconds
+    Timeout int         `json:"timeout"`
+}
+
+type RecoveryStrategy struct {
+    Name    string          `json:"name"`
+    Steps   []RecoveryStep  `json:"steps"`
+}
+
+type RecoveryOutcome struct {
+    Time    time.Time       `json:"time"`
+    Room    string          `json:"room"`
+    Outcome recoveryState   `json:"outcome"`
+    // Last step that has been started
+    Step    int             `json:"step"`
+}
+
+type RecoveryStats struct {
+    Runs        int                 `json:"runs"`
+    Docked      int                 `json:"docked"`
+    Failed      int                 `json:"failed"`
+    Cancelled   int                 `json:"cancelled"`
+    Last        []RecoveryOutcome   `json:"last"`
+}
+
+// The sequence that used to be hard-coded in cleanRoom
+var builtinRecoveryStrategy = RecoveryStrategy{
+    Name: defaultRecoveryStrategy,
+    Steps: []RecoveryStep{
+        // Dock not found
+        {Action: recoveryActionWait, Timeout: 5},
+        {Action: recoveryActionGoto, Until: "idle", Timeout: 300},
+        // The robot usually returns on its own from the idle point
+        {Action: recoveryActionWait, Until: "idle", Timeout: 120},
+        // Orientation drives
+        {Action: recoveryActionVolume, Volume: 0},
+        {Action: recoveryActionDock, Until: "idle", Timeout: 600},
+        {Action: recoveryActionDock, Until: "idle", Timeout: 600},
+        // We should have updated our map, going home now
+        {Action: recoveryActionVolume, Volume: 100},
+        {Action: recoveryActionDock, Until: "idle", Timeout: 600},
+        // Let's try one last time
+        {Action: recoveryActionDock, Until: "idle", Timeout: 600},
+    },
+}
+
+var recoveryMutex sync.Mutex
+var recoveryStrategies []RecoveryStrategy
+var recoveryStats = map[string]*RecoveryStats{}
+
+func (step RecoveryStep) Validate() error {
+    switch step.Action {
+    case recoveryActionGoto:
+        if len(step.Point) != 0 && len(step.Point) != 2 {
+            return fmt.Errorf("point has %d elements, expected [x,y]", len(step.Point))
+        }
+    case recoveryActionVolume:
+        if step.Volume < 0 || step.Volume > 100 {
+            return fmt.Errorf("volume %d is not between 0 and 100", step.Volume)
+        }
+    case recoveryActionDock, recoveryActionWait, recoveryActionFindMe:
+    default:
+        return errors.New("unknown action " + step.Action)
+    }
+
+    if _, ok := recoveryConditionStates[step.Until]; !ok &&
+            step.Until != "" && step.Until != "charging" {
+        return errors.New("unknown condition " + step.Until)
+    }
+
+    if step.Timeout < 0 {
+        return fmt.Errorf("negative timeout %d", step.Timeout)
+    }
+
+    // Without a timeout the step would be skipped right away
+    needsTimeout := step.Until != "" || step.Action == recoveryActionGoto ||
+        step.Action == recoveryActionDock || step.Action == recoveryActionWait
+    if needsTimeout && step.Timeout == 0 {
+        return errors.New(step.Action + " step needs a timeout")
+    }
+
+    return nil
+}
+
+func (strategy RecoveryStrategy) Validate() error {
+    if strategy.Name == "" {
+        return errors.New("Recovery strategy without name!")
+    }
+
+    if len(strategy.Steps) == 0 {
+        return errors.New("Recovery strategy " + strategy.Name + " has no steps!")
+    }
+
+    for index, step := range strategy.Steps {
+        if err := step.Validate(); err != nil {
+            return fmt.Errorf("Recovery strategy %s, step %d: %s!", strategy.Name, index, err.Error())
+        }
+    }
+
+    return nil
+}
+
+func loadRecoveryStrategies() error {
+    var strategies []RecoveryStrategy
+    stats := map[string]*RecoveryStats{}
+
+    if err := ReadJSONFile(recoveryStrategiesPath, &strategies); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    // Losing the statistics must not cost the strategies
+    var statsErr error
+    if err := ReadJSONFile(recoveryStatsPath, &stats); err != nil && !os.IsNotExist(err) {
+        statsErr = fmt.Errorf("%s: %s", recoveryStatsPath, err.Error())
+        stats = map[string]*RecoveryStats{}
+    }
+
+    recoveryMutex.Lock()
+    recoveryStrategies = strategies
+    recoveryStats = stats
+    recoveryMutex.Unlock()
+
+    return statsErr
+}
+
+// checkNoGoPoints fails if a goto step would send the robot into a no-go
+// area. Steps without a point go to idlePoint, which may be unknown yet.
+func (strategy RecoveryStrategy) checkNoGoPoints(idlePoint Coordinates) error {
+    for index, step := range strategy.Steps {
+        if step.Action != recoveryActionGoto {
+            continue
+        }
+
+        point := step.Point
+        if len(point) == 0 {
+            point = idlePoint
+        }
+
+        if len(point) != 2 {
+            continue
+        }
+
+        if err := checkNoGo(point[0], point[1]); err != nil {
+            return fmt.Errorf("Recovery strategy %s, step %d: %s", strategy.Name, index, err.Error())
+        }
+    }
+
+    return nil
+}
+
+func setRecoveryStrategies(strategies []RecoveryStrategy) error {
+    names := map[string]bool{}
+
+    for _, strategy := range strategies {
+        if err := strategy.Validate(); err != nil {
+            return err
+        }
+
+        if err := strategy.checkNoGoPoints(nil); err != nil {
+            return err
+        }
+
+        if names[strategy.Name] {
+            return errors.New("Duplicate recovery strategy " + strategy.Name + "!")
+        }
+        names[strategy.Name] = true
+    }
+
+    recoveryMutex.Lock()
+    defer recoveryMutex.Unlock()
+
+    if err := WriteJSONFile(recoveryStrategiesPath, strategies); err != nil {
+        return err
+    }
+
+    recoveryStrategies = strategies
+
+    return nil
+}
+
+// getRecoveryStrategy looks up a configured strategy. The built-in strategy
+// is used for rooms without one unless it got overridden.
+func getRecoveryStrategy(name string) (RecoveryStrategy, error) {
+    if name == "" {
+        name = defaultRecoveryStrategy
+    }
+
+    recoveryMutex.Lock()
+    defer recoveryMutex.Unlock()
+
+    for _, strategy := range recoveryStrategies {
+        if strategy.Name == name {
+            return strategy, nil
+        }
+    }
+
+    if name == defaultRecoveryStrategy {
+        return builtinRecoveryStrategy, nil
+    }
+
+    return RecoveryStrategy{}, errors.New("Unknown recovery strategy " + name + "!")
+}
+
+func recordRecoveryOutcome(strategy string, outcome RecoveryOutcome) {
+    recoveryMutex.Lock()
+    defer recoveryMutex.Unlock()
+
+    stats, ok := recoveryStats[strategy]
+    if !ok {
+        stats = &RecoveryStats{}
+        recoveryStats[strategy] = stats
+    }
+
+    stats.Runs++
+    switch outcome.Outcome {
+    case recoveryStateDocked:
+        stats.Docked++
+    case recoveryStateCancelled:
+        stats.Cancelled++
+    default:
+        stats.Failed++
+    }
+
+    stats.Last = append(stats.Last, outcome)
+    if len(stats.Last) > recoveryOutcomeHistory {
+        stats.Last = stats.Last[len(stats.Last) - recoveryOutcomeHistory:]
+    }
+
+    if err := WriteJSONFile(recoveryStatsPath, recoveryStats); err != nil {
+        fmt.Printf("recordRecoveryOutcome: %s\n", err.Error())
+    }
+}
@@ -3,11 +3,13 @@ package main
 import (
     "crypto/md5"
     "encoding/hex"
+    "encoding/json"
     "io"
     "io/ioutil"
     "math/rand"
     "net"
     "os"
+    "path"
     "strconv"
     "strings"
 )
@@ -72,3 +74,31 @@ func FileChecksum(filepath string) (string, error) {
 
     return hash, nil
 }
+
+func ReadJSONFile(filepath string, v interface{}) error {
+    data, err := ioutil.ReadFile(filepath)
+    if err != nil {
+        return err
+    }
+
+    return json.Unmarshal(data, v)
+}
+
+// WriteJSONFile replaces the file atomically.
+func WriteJSONFile(filepath string, v interface{}) error {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(path.Dir(filepath), os.ModePerm); err != nil {
+        return err
+    }
+
+    tmpPath := filepath + ".tmp"
+    if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+        return err
+    }
+
+    return os.Rename(tmpPath, filepath)
+}
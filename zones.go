@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+const (
+    // The firmware refuses app_zoned_clean with more zones
+    maxZones = 5
+    // Rooms with more zones are cleaned in batches of maxZones
+    maxRoomZones = 25
+    maxZoneRepeats = 3
+
+    // Robot coordinates are millimetres on a 1024x1024 grid of 50mm cells
+    mapMinCoordinate = 0
+    mapMaxCoordinate = 51200
+)
+
+// Zone is a rectangle as understood by app_zoned_clean:
+// [x1, y1, x2, y2, repeats]
+type Zone struct {
+    X1      int
+    Y1      int
+    X2      int
+    Y2      int
+    Repeats int
+}
+
+type RoomZones []Zone
+
+func (z *Zone) UnmarshalJSON(data []byte) error {
+    var values []int
+
+    if err := json.Unmarshal(data, &values); err != nil {
+        return err
+    }
+
+    if len(values) != 5 {
+        return fmt.Errorf("Zone %s has %d elements, expected [x1,y1,x2,y2,repeats]!", string(data), len(values))
+    }
+
+    *z = Zone{values[0], values[1], values[2], values[3], values[4]}
+
+    return nil
+}
+
+func (z Zone) MarshalJSON() ([]byte, error) {
+    return json.Marshal(z.Params())
+}
+
+// Params returns the zone in the firmware's parameter format.
+func (z Zone) Params() []int {
+    return []int{z.X1, z.Y1, z.X2, z.Y2, z.Repeats}
+}
+
+func (z Zone) Validate() error {
+    if z.X1 == z.X2 || z.Y1 == z.Y2 {
+        return errors.New("zero-area rectangle")
+    }
+
+    if z.X1 > z.X2 {
+        return fmt.Errorf("x1 (%d) is greater than x2 (%d)", z.X1, z.X2)
+    }
+
+    if z.Y1 > z.Y2 {
+        return fmt.Errorf("y1 (%d) is greater than y2 (%d)", z.Y1, z.Y2)
+    }
+
+    for _, value := range z.Params()[:4] {
+        if value < mapMinCoordinate || value > mapMaxCoordinate {
+            return fmt.Errorf("coordinate %d is outside of the map (%d-%d)", value, mapMinCoordinate, mapMaxCoordinate)
+        }
+    }
+
+    if z.Repeats < 1 || z.Repeats > maxZoneRepeats {
+        return fmt.Errorf("repeat count %d is not between 1 and %d", z.Repeats, maxZoneRepeats)
+    }
+
+    return nil
+}
+
+// Params returns the zones in the format expected by Vacuum.ZonedClean.
+func (zones RoomZones) Params() [][]int {
+    params := make([][]int, len(zones))
+    for index, zone := range zones {
+        params[index] = zone.Params()
+    }
+
+    return params
+}
+
+// Batches splits the zones into lists the firmware accepts at once.
+func (zones RoomZones) Batches() []RoomZones {
+    var batches []RoomZones
+
+    for start := 0; start < len(zones); start += maxZones {
+        end := start + maxZones
+        if end > len(zones) {
+            end = len(zones)
+        }
+
+        batches = append(batches, zones[start:end])
+    }
+
+    return batches
+}
+
+func (zones RoomZones) Validate() error {
+    if len(zones) == 0 {
+        return errors.New("No zones given!")
+    }
+
+    if len(zones) > maxRoomZones {
+        return fmt.Errorf("Too many zones: %d, at most %d are supported!", len(zones), maxRoomZones)
+    }
+
+    for index, zone := range zones {
+        if err := zone.Validate(); err != nil {
+            return fmt.Errorf("Invalid zone %d: %s!", index, err.Error())
+        }
+    }
+
+    return nil
+}
+
+func (room Room) Validate() error {
+    if err := room.Zones.Validate(); err != nil {
+        return err
+    }
+
+    if len(room.IdlePoint) != 2 {
+        return fmt.Errorf("Idle point has %d elements, expected [x,y]!", len(room.IdlePoint))
+    }
+
+    for _, value := range room.IdlePoint {
+        if value < mapMinCoordinate || value > mapMaxCoordinate {
+            return fmt.Errorf("Idle point coordinate %d is outside of the map (%d-%d)!", value, mapMinCoordinate, mapMaxCoordinate)
+        }
+    }
+
+    if room.FanPower < 0 || room.FanPower > 100 {
+        return fmt.Errorf("Fan power %d is not between 0 and 100!", room.FanPower)
+    }
+
+    return nil
+}
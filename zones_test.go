@@ -0,0 +1,146 @@
+package main
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+func TestZoneJSON(t *testing.T) {
+    var zones RoomZones
+    if err := json.Unmarshal([]byte(`[[100,200,300,400,1],[0,0,51200,51200,3]]`), &zones); err != nil {
+        t.Fatal(err)
+    }
+
+    expected := RoomZones{{100, 200, 300, 400, 1}, {0, 0, 51200, 51200, 3}}
+    if !reflect.DeepEqual(zones, expected) {
+        t.Fatalf("Decoded %v, expected %v", zones, expected)
+    }
+
+    data, err := json.Marshal(zones)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(data) != `[[100,200,300,400,1],[0,0,51200,51200,3]]` {
+        t.Fatalf("Encoded %s", data)
+    }
+
+    invalid := []string{
+        `[100,200,300,400]`,
+        `[100,200,300,400,1,2]`,
+        `[100,200,300,400,1.5]`,
+        `{"x1":100}`,
+        `"100,200,300,400,1"`,
+    }
+
+    for _, payload := range invalid {
+        var zone Zone
+        if err := json.Unmarshal([]byte(payload), &zone); err == nil {
+            t.Errorf("Zone %s accepted", payload)
+        }
+    }
+}
+
+func TestZoneValidate(t *testing.T) {
+    tests := []struct {
+        zone    Zone
+        valid   bool
+    }{
+        {Zone{100, 200, 300, 400, 1}, true},
+        {Zone{0, 0, 51200, 51200, 3}, true},
+        // Zero area
+        {Zone{100, 200, 100, 400, 1}, false},
+        {Zone{100, 200, 300, 200, 1}, false},
+        // Corners swapped
+        {Zone{300, 200, 100, 400, 1}, false},
+        {Zone{100, 400, 300, 200, 1}, false},
+        // Outside of the map
+        {Zone{-1, 200, 300, 400, 1}, false},
+        {Zone{100, 200, 300, 51201, 1}, false},
+        // Repeats
+        {Zone{100, 200, 300, 400, 0}, false},
+        {Zone{100, 200, 300, 400, 4}, false},
+    }
+
+    for _, test := range tests {
+        if err := test.zone.Validate(); (err == nil) != test.valid {
+            t.Errorf("Zone %v: valid %t, got %v", test.zone, test.valid, err)
+        }
+    }
+}
+
+func TestRoomZonesValidate(t *testing.T) {
+    zone := Zone{100, 200, 300, 400, 1}
+
+    if err := (RoomZones{}).Validate(); err == nil {
+        t.Error("No zones accepted")
+    }
+
+    zones := RoomZones{}
+    for len(zones) < maxRoomZones {
+        zones = append(zones, zone)
+    }
+
+    if err := zones.Validate(); err != nil {
+        t.Errorf("%d zones rejected: %s", len(zones), err.Error())
+    }
+
+    if err := append(zones, zone).Validate(); err == nil {
+        t.Errorf("%d zones accepted", len(zones) + 1)
+    }
+
+    if err := (RoomZones{zone, {100, 200, 100, 400, 1}}).Validate(); err == nil {
+        t.Error("Invalid second zone accepted")
+    }
+}
+
+func TestRoomZonesBatches(t *testing.T) {
+    var zones RoomZones
+    for index := 0; index < 2 * maxZones + 1; index++ {
+        zones = append(zones, Zone{100 * index, 0, 100 * index + 50, 50, 1})
+    }
+
+    for _, length := range []int{0, 1, maxZones, maxZones + 1, 2 * maxZones + 1} {
+        batches := zones[:length].Batches()
+
+        var joined RoomZones
+        for _, batch := range batches {
+            if len(batch) == 0 || len(batch) > maxZones {
+                t.Errorf("%d zones: batch of %d", length, len(batch))
+            }
+
+            joined = append(joined, batch...)
+        }
+
+        if expected := (length + maxZones - 1) / maxZones; len(batches) != expected {
+            t.Errorf("%d zones: %d batches, expected %d", length, len(batches), expected)
+        }
+
+        if length > 0 && !reflect.DeepEqual(joined, zones[:length]) {
+            t.Errorf("%d zones: batches %v", length, batches)
+        }
+    }
+}
+
+func TestRoomValidate(t *testing.T) {
+    zones := RoomZones{{100, 200, 300, 400, 1}}
+
+    tests := []struct {
+        idlePoint   Coordinates
+        valid       bool
+    }{
+        {Coordinates{25000, 25000}, true},
+        {nil, false},
+        {Coordinates{25000}, false},
+        {Coordinates{25000, 25000, 0}, false},
+        {Coordinates{25000, 51201}, false},
+    }
+
+    for _, test := range tests {
+        room := Room{Zones: zones, IdlePoint: test.idlePoint}
+        if err := room.Validate(); (err == nil) != test.valid {
+            t.Errorf("Idle point %v: valid %t, got %v", test.idlePoint, test.valid, err)
+        }
+    }
+}